@@ -51,6 +51,10 @@ func init() {
 		// use a callback for processing CIFSD_TOOLS_SRC
 		InventoryCB: InventoryCB,
 
+		ConfRequired: []string{"CIFSD_TOOLS_SRC", "CIFS_USER",
+			"CIFS_PW", "CIFS_SHARE"},
+		ConfDirs: []string{"CIFSD_TOOLS_SRC"},
+
 		VMResources: rapidos.Resources{
 			Network: true,
 			CPUs:    2,
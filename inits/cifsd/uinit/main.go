@@ -36,44 +36,61 @@ const (
 )
 
 func main() {
-	zramDev := uinit_common.ProvisionZram(zramDisksize)
+	zramDev, err := uinit_common.ProvisionZram(zramDisksize)
+	if err != nil {
+		uinit_common.Fail("zram provisioning", err)
+	}
 
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
+	}
+	err = uinit_common.SetupIPv6()
+	if err != nil {
+		uinit_common.Fail("IPv6 setup", err)
 	}
-	uinit_common.EnableDynDebug(c)
 
 	cmd := exec.Command("mkfs.xfs", zramDev)
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		log.Fatalf("mkfs failed: %v", err)
+		uinit_common.Fail("mkfs", err)
 	}
 
 	_, err = mount.Mount(zramDev, "/root", "xfs", "", 0)
 	if err != nil {
-		log.Fatalf("mount failed: %v", err)
+		uinit_common.Fail("zram mount", err)
 	}
 
 	cmd = exec.Command("chmod", "0777", "/root")
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		log.Fatalf("chmod failed: %v", err)
+		uinit_common.Fail("chmod", err)
 	}
 
 	err = kmodule.Probe("cifsd", "")
 	if err != nil {
-		log.Fatalf("failed to load cifsd kmod: %v", err)
+		uinit_common.Fail("cifsd kmod load", err)
 	}
 
 	err = os.MkdirAll("/etc/cifs", 0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("smb.conf setup", err)
 	}
 
-	cifsdToolsSrc := uinit_common.GetDirPath(c, "CIFSD_TOOLS_SRC")
+	cifsdToolsSrc, err := uinit_common.GetDirPath(c, "CIFSD_TOOLS_SRC")
+	if err != nil {
+		uinit_common.Fail("CIFSD_TOOLS_SRC lookup", err)
+	}
 
 	pathOld := os.Getenv("PATH")
 	// modify PATH so that FindBins looks in the user source dir
@@ -84,34 +101,39 @@ func main() {
 
 	cifsOpts := uinit_common.GetCifsOpts(c)
 
-	cmd = exec.Command("cifsadmin", "-a", cifsOpts.User, "-p", cifsOpts.Pw)
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		log.Fatalf("cifsadmin failed: %v", err)
-	}
-
 	// XXX using templates adds ~1M to init - do it in cut!!
 	tmpl, err := template.New("smb.conf").Parse(conf)
 	if err != nil {
-		log.Fatalf("tmpl failed: %v", err)
+		uinit_common.Fail("smb.conf setup", err)
 	}
 
 	f, err := os.Create("/etc/cifs/smb.conf")
 	if err != nil {
-		log.Fatalf("failed to write conf %v\n", err)
+		uinit_common.Fail("smb.conf setup", err)
 	}
 	err = tmpl.Execute(f, cifsOpts)
 	f.Close()
 	if err != nil {
-		log.Fatalf("failed to write conf %v\n", err)
+		uinit_common.Fail("smb.conf setup", err)
 	}
 
-	cmd = exec.Command("cifsd")
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	err = cmd.Run()
+	// cifsd daemonizes itself, so is run to completion
+	err = uinit_common.RunServices([]uinit_common.Service{
+		{
+			Name: "cifsadmin",
+			Cmd: []string{"cifsadmin", "-a", cifsOpts.User,
+				"-p", cifsOpts.Pw},
+			Oneshot: true,
+		},
+		{
+			Name:    "cifsd",
+			Cmd:     []string{"cifsd"},
+			Oneshot: true,
+			Deps:    []string{"cifsadmin"},
+		},
+	})
 	if err != nil {
-		log.Fatalf("cifsd failed: %v", err)
+		uinit_common.Fail("services", err)
 	}
 	log.Print("cifsd loaded and running\n")
 }
@@ -12,9 +12,26 @@
 package example
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/pki"
 	"gitlab.com/rapidos/rapidos/internal/pkg/rapidos"
 )
 
+const (
+	// generated CA and certificates are placed in this directory alongside
+	// the image, so that host clients can use the CA certificate
+	pkiDirName = "etcd-pki"
+	// initramfs destination, which must match the uinit
+	pkiImgDir = "/etc/etcd/pki"
+	// the CA is regenerated with each cut, so needn't be long-lived
+	pkiValidity = time.Duration(365 * 24 * time.Hour)
+)
+
 func init() {
 	manifest := rapidos.Manifest{
 		Name:  "etcd",
@@ -31,12 +48,94 @@ func init() {
 			Bins:  []string{"mkfs.xfs"},
 			Files: []string{},
 		},
+		// generates TLS certificates for each VM
+		InventoryCB: InventoryCB,
+		// hostname and address of each -cluster VM form the initial
+		// cluster
+		ConfVMDefs: true,
 		VMResources: rapidos.Resources{
 			Network: true,
 			CPUs:    2,
 			Memory:  "1024M",
+			// etcd client port, forwarded with NET_MODE="user"
+			Ports: []uint16{2379},
 		},
 	}
 
 	rapidos.AddManifest(manifest)
 }
+
+// add @data to @inv as @name under pkiImgDir, via a local copy in @pkiDir
+func addPKIFile(inv *rapidos.Inventory, pkiDir string, name string,
+	data []byte, perm os.FileMode) error {
+	localPath := path.Join(pkiDir, name)
+	err := ioutil.WriteFile(localPath, data, perm)
+	if err != nil {
+		return err
+	}
+	inv.Files = append(inv.Files,
+		localPath+":"+path.Join(pkiImgDir, name))
+	return nil
+}
+
+// Generate a throwaway CA, and a server/peer certificate for each VM with a
+// hostname and static address in rapidos.conf. Certificates also carry the
+// loopback addresses for forwarded NET_MODE="user" access. VMs without a
+// certificate fall back to plain http.
+func InventoryCB(conf rapidos.RapidosConf, inv *rapidos.Inventory) error {
+	pkiDir := path.Join(conf.ImgDir, pkiDirName)
+	// drop certificates for VMs which are no longer configured
+	err := os.RemoveAll(pkiDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(pkiDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	ca, err := pki.NewCA("rapidos etcd CA", pkiValidity)
+	if err != nil {
+		return err
+	}
+	err = addPKIFile(inv, pkiDir, "ca.pem", ca.CertPEM, 0644)
+	if err != nil {
+		return err
+	}
+
+	for vmIndex := 1; vmIndex <= conf.NumVMDefs(); vmIndex++ {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			return err
+		}
+		var ips []net.IP
+		for _, addr := range []string{vmDef.IPAddr, vmDef.IP6Addr} {
+			if addr != "" {
+				ips = append(ips, net.ParseIP(addr))
+			}
+		}
+		if vmDef.Hostname == "" || len(ips) == 0 {
+			continue
+		}
+		// NET_MODE="user" forwards the client port from host loopback
+		ips = append(ips, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+
+		certPEM, keyPEM, err := ca.Issue(vmDef.Hostname, ips,
+			pkiValidity)
+		if err != nil {
+			return err
+		}
+		err = addPKIFile(inv, pkiDir, vmDef.Hostname+".pem", certPEM,
+			0644)
+		if err != nil {
+			return err
+		}
+		err = addPKIFile(inv, pkiDir, vmDef.Hostname+"-key.pem",
+			keyPEM, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -12,10 +12,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/u-root/u-root/pkg/mount"
@@ -23,129 +31,246 @@ import (
 	"gitlab.com/rapidos/rapidos/inits/uinit_common"
 )
 
-const zramDisksize = "2G"
-
-type State int
-
 const (
-	unknown State = iota
-	etcdStarting
-	etcdStarted
-	etcdExited
+	zramDisksize = "2G"
+	clientPort   = "2379"
+	peerPort     = "2380"
+	// CA and per-hostname certificates generated by the manifest InventoryCB
+	pkiDir = "/etc/etcd/pki"
 )
 
-func startEtcd(ch chan<- State, dataDir string) {
+// peer URLs for @vmDef's static addresses
+func vmPeerURLs(vmDef uinit_common.VMDef, scheme string) []string {
+	var urls []string
+	for _, ip := range []string{vmDef.IPAddr, vmDef.IP6Addr} {
+		if ip != "" {
+			urls = append(urls, scheme+"://"+
+				net.JoinHostPort(ip, peerPort))
+		}
+	}
+	return urls
+}
+
+// Build the --initial-cluster member list from the rapidos.conf VM
+// definitions for @clusterVMs, alongside the peer URLs which this (@hostname)
+// member should advertise. VMs without a static address are skipped, as their
+// peer URLs aren't known ahead of time. nil is returned if @hostname isn't
+// found, including when the VM wasn't booted as part of a -cluster.
+func getInitialCluster(vmDefs []uinit_common.VMDef, clusterVMs []int,
+	hostname string, scheme string) ([]string, []string) {
+	var members, advertise []string
+
+	for _, vmDef := range vmDefs {
+		inCluster := false
+		for _, vmIndex := range clusterVMs {
+			inCluster = inCluster || vmIndex == vmDef.Index
+		}
+		if !inCluster {
+			continue
+		}
+		urls := vmPeerURLs(vmDef, scheme)
+		for _, url := range urls {
+			members = append(members, vmDef.Hostname+"="+url)
+		}
+		if vmDef.Hostname == hostname {
+			advertise = urls
+		}
+	}
+	if advertise == nil {
+		return nil, nil
+	}
+	return members, advertise
+}
+
+// return etcd arguments for TLS with the certificate generated for @hostname,
+// alongside the CA pool for verifying etcd. nil is returned if no certificate
+// was generated, e.g. for VMs without a static address.
+func getTLSConf(hostname string) ([]string, *x509.CertPool, error) {
+	caPath := path.Join(pkiDir, "ca.pem")
+	certPath := path.Join(pkiDir, hostname+".pem")
+	keyPath := path.Join(pkiDir, hostname+"-key.pem")
+
+	_, err := os.Stat(certPath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CA certificate: %v",
+			err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("invalid CA certificate in %s",
+			caPath)
+	}
+
+	// clients only need the CA, while peers must authenticate each other
+	args := []string{"--cert-file", certPath, "--key-file", keyPath,
+		"--trusted-ca-file", caPath,
+		"--peer-cert-file", certPath, "--peer-key-file", keyPath,
+		"--peer-trusted-ca-file", caPath, "--peer-client-cert-auth"}
+	return args, caPool, nil
+}
+
+// etcd is ready once its client health endpoint reports an elected leader,
+// which requires a quorum of initial cluster members
+func etcdHealthProbe(cliURL string, caPool *x509.CertPool) uinit_common.Probe {
+	client := http.Client{Timeout: time.Duration(time.Second)}
+	if caPool != nil {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: caPool},
+		}
+	}
+	return func() bool {
+		resp, err := client.Get(cliURL + "/health")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		var health struct {
+			Health string `json:"health"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&health)
+		return err == nil && health.Health == "true"
+	}
+}
+
+// return the etcd service, with arguments determined from the local addresses
+// and the @vmDefs of @clusterVMs
+func getEtcdService(dataDir string, vmDefs []uinit_common.VMDef,
+	clusterVMs []int) (*uinit_common.Service, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatalf("failed to get hostname: %v", err)
+		return nil, fmt.Errorf("failed to get hostname: %v", err)
 	}
 
-	etcdArgs := []string{"--name", hostname, "--data-dir", "/root",
+	etcdArgs := []string{"etcd", "--name", hostname, "--data-dir", dataDir,
 		"--initial-cluster-token", "rapidos-etcd-cluster",
 		"--initial-cluster-state", "new"}
-	// TODO support CA and --initial-cluster node list configuration in
-	// rapidos.conf
+
+	scheme := "http"
+	tlsArgs, caPool, err := getTLSConf(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if tlsArgs != nil {
+		scheme = "https"
+		etcdArgs = append(etcdArgs, tlsArgs...)
+	} else {
+		log.Printf("no certificate for %s, using plain http\n",
+			hostname)
+	}
 
 	// Add client + peer listen URLs for each non-loopback addr
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatalf("failed to get network addresses: %v", err)
+		return nil, fmt.Errorf("failed to get network addresses: %v",
+			err)
 	}
+	var peerURLs, cliURLs []string
 	cliAddr := ""
 	for _, addr := range addrs {
 		ipnet, ok := addr.(*net.IPNet)
-		// FIXME support https and IPv6!
-		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
-			continue // skip loopback and non-V4 addresses
+		if !ok || ipnet.IP.IsLoopback() ||
+			ipnet.IP.IsLinkLocalUnicast() {
+			continue // skip loopback and link-local addresses
 		}
 
-		etcdArgs = append(etcdArgs, "--listen-peer-urls",
-			"http://"+ipnet.IP.String()+":2380",
-			"--initial-advertise-peer-urls",
-			"http://"+ipnet.IP.String()+":2380")
-
-		cliAddr = ipnet.IP.String() + ":2379"
-		etcdArgs = append(etcdArgs,
-			"--listen-client-urls", "http://"+cliAddr,
-			"--advertise-client-urls", "http://"+cliAddr)
+		peerURLs = append(peerURLs, scheme+"://"+
+			net.JoinHostPort(ipnet.IP.String(), peerPort))
+		cliURLs = append(cliURLs, scheme+"://"+
+			net.JoinHostPort(ipnet.IP.String(), clientPort))
+		if cliAddr == "" {
+			cliAddr = net.JoinHostPort(ipnet.IP.String(),
+				clientPort)
+		}
 	}
 	if cliAddr == "" {
-		log.Fatalf("no non-loopback v4 addresses present\n")
+		return nil, fmt.Errorf("no non-loopback addresses present")
 	}
 
-	cmd := exec.Command("etcd", etcdArgs...)
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	err = cmd.Start()
-	if err != nil {
-		log.Fatalf("etcd failed to start: %v", err)
-	}
-
-	// wait for etcd to start listening. timeout handled by caller
-	for {
-		conn, _ := net.Dial("tcp", cliAddr)
-		if conn != nil {
-			conn.Close()
-			break
+	members, advertisePeerURLs := getInitialCluster(vmDefs, clusterVMs,
+		hostname, scheme)
+	if members == nil {
+		// not booted via -cluster, or not statically configured (e.g.
+		// DHCP), so run standalone
+		log.Printf("%s not in a -cluster with a static address, "+
+			"starting single node cluster\n", hostname)
+		advertisePeerURLs = peerURLs
+		for _, url := range peerURLs {
+			members = append(members, hostname+"="+url)
 		}
-		time.Sleep(time.Duration(100 * time.Millisecond))
 	}
-	ch <- etcdStarted
+	etcdArgs = append(etcdArgs,
+		"--initial-cluster", strings.Join(members, ","),
+		"--listen-peer-urls", strings.Join(peerURLs, ","),
+		"--initial-advertise-peer-urls",
+		strings.Join(advertisePeerURLs, ","),
+		"--listen-client-urls", strings.Join(cliURLs, ","),
+		"--advertise-client-urls", strings.Join(cliURLs, ","))
 
-	err = cmd.Wait()
-	if err != nil {
-		log.Fatalf("etcd failed: %v", err)
-	}
-
-	ch <- etcdExited
+	return &uinit_common.Service{
+		Name:  "etcd",
+		Cmd:   etcdArgs,
+		Ready: etcdHealthProbe(scheme+"://"+cliAddr, caPool),
+		// other cluster members may still be booting
+		ReadyTimeout: time.Duration(2 * time.Minute),
+		Restart:      uinit_common.RestartOnFailure,
+	}, nil
 }
 
 func main() {
-	zramDev := uinit_common.ProvisionZram(zramDisksize)
+	zramDev, err := uinit_common.ProvisionZram(zramDisksize)
+	if err != nil {
+		uinit_common.Fail("zram provisioning", err)
+	}
 
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
+	}
+	err = uinit_common.SetupIPv6()
+	if err != nil {
+		uinit_common.Fail("IPv6 setup", err)
 	}
-	uinit_common.EnableDynDebug(c)
 
 	cmd := exec.Command("mkfs.xfs", zramDev)
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		log.Fatalf("mkfs failed: %v", err)
+		uinit_common.Fail("mkfs", err)
 	}
 
 	_, err = mount.Mount(zramDev, "/root", "xfs", "", 0)
 	if err != nil {
-		log.Fatalf("mount failed: %v", err)
-	}
-
-	// start etcd in the background and track its state via channel
-	etcdChan := make(chan State)
-	go func() {
-		startEtcd(etcdChan, "/root")
-	}()
-
-	var state State = etcdStarting
-	stateTransTimeout := time.Duration(10 * time.Second)
-	stateTransTimer := time.NewTimer(stateTransTimeout)
-	for {
-		select {
-		case state = <-etcdChan:
-			log.Printf("etcd service state: %v\n", state)
-			if state == etcdStarted {
-				if !stateTransTimer.Stop() {
-					<-stateTransTimer.C
-				}
-				// stateTransTimer.Reset(stateTransTimeout)
-				// XXX subsequent services depending on etcd
-				// could be started here.
-			} else {
-				log.Fatalf("unexpected etcd state: %v",
-					state)
-			}
-		case <-stateTransTimer.C:
-			log.Fatalf("State %v transition timeout!", state)
-		}
+		uinit_common.Fail("zram mount", err)
+	}
+
+	clusterVMs, err := uinit_common.GetClusterVMs()
+	if err != nil {
+		uinit_common.Fail("cluster parsing", err)
+	}
+
+	// XXX subsequent services depending on etcd can be added here
+	etcdSvc, err := getEtcdService("/root", uinit_common.GetVMDefs(c),
+		clusterVMs)
+	if err != nil {
+		uinit_common.Fail("etcd setup", err)
+	}
+	err = uinit_common.RunServices([]uinit_common.Service{*etcdSvc})
+	if err != nil {
+		uinit_common.Fail("services", err)
 	}
 }
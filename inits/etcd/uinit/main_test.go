@@ -0,0 +1,59 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/rapidos/rapidos/inits/uinit_common"
+)
+
+func TestInitialCluster(t *testing.T) {
+	vmDefs := []uinit_common.VMDef{
+		{Index: 1, Hostname: "rapido1", IPAddr: "192.168.155.101"},
+		{Index: 2, Hostname: "rapido2", IPAddr: "192.168.155.102"},
+	}
+	url1 := "https://192.168.155.101:2380"
+	url2 := "https://192.168.155.102:2380"
+
+	// booted on its own, e.g. via -boot, so no quorum to wait for
+	members, advertise := getInitialCluster(vmDefs, nil, "rapido1",
+		"https")
+	if members != nil || advertise != nil {
+		t.Errorf("unexpected standalone cluster: %v %v", members,
+			advertise)
+	}
+
+	// one VM of the two defined
+	members, advertise = getInitialCluster(vmDefs, []int{2}, "rapido2",
+		"https")
+	if !reflect.DeepEqual(members, []string{"rapido2=" + url2}) ||
+		!reflect.DeepEqual(advertise, []string{url2}) {
+		t.Errorf("unexpected single VM cluster: %v %v", members,
+			advertise)
+	}
+
+	members, advertise = getInitialCluster(vmDefs, []int{1, 2}, "rapido1",
+		"https")
+	if !reflect.DeepEqual(members,
+		[]string{"rapido1=" + url1, "rapido2=" + url2}) ||
+		!reflect.DeepEqual(advertise, []string{url1}) {
+		t.Errorf("unexpected two VM cluster: %v %v", members, advertise)
+	}
+
+	// this VM isn't among the cluster VMs
+	members, _ = getInitialCluster(vmDefs, []int{2}, "rapido1", "https")
+	if members != nil {
+		t.Errorf("unexpected cluster without local VM: %v", members)
+	}
+}
@@ -53,12 +53,39 @@ func init() {
 			// Additional miscellaneous files can be listed below.
 			Files: []string{},
 		},
+		// rapidos.conf keys used by the init are declared here, so that
+		// "rapidos -validate" can check them before an image is cut.
+		// Only declared keys are embedded in the image.
+		// ConfRequired keys must be set, ConfOptional keys may be set,
+		// and ConfDirs keys must refer to an existing directory.
+		ConfRequired: []string{},
+		ConfOptional: []string{},
+		ConfDirs:     []string{},
 		// VMResources are passed through to qemu when the image is
 		// booted via "rapidos -boot".
 		VMResources: rapidos.Resources{
 			Network: false,
 			CPUs:    2,
 			Memory:  "512M",
+			// Additional sparse file backed disks, NUMA nodes,
+			// hugepage backed memory and a QEMU CPU model can also
+			// be requested, e.g.
+			// Disks: []rapidos.Disk{{Size: "1G", Bus: "virtio"}},
+			// CPUModel: "host",
+			// NUMANodes: []rapidos.NUMANode{
+			//	{CPUs: "0", Memory: "256M"},
+			//	{CPUs: "1", Memory: "256M"},
+			// },
+			// HugePages: true,
+			//
+			// Supplementary QEMU arguments and kernel parameters
+			// are applied whenever the image is booted, e.g.
+			// QEMUArgs: []string{"-gdb", "tcp:127.0.0.1:1234"},
+			// KernelArgs: []string{"loglevel=8"},
+			//
+			// Guest TCP ports to forward from the host when booted
+			// with NET_MODE="user", e.g.
+			// Ports: []uint16{8080},
 		},
 	}
 
@@ -13,7 +13,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 
@@ -26,26 +25,39 @@ const zramDisksize = "100M"
 
 func main() {
 	// kernel modules should be loaded prior to EnableDynDebug()
-	zramDev := uinit_common.ProvisionZram(zramDisksize)
+	zramDev, err := uinit_common.ProvisionZram(zramDisksize)
+	if err != nil {
+		uinit_common.Fail("zram provisioning", err)
+	}
 
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
 	}
-	uinit_common.EnableDynDebug(c)
 
 	cmd := exec.Command("mkfs.xfs", zramDev)
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		log.Fatalf("mkfs failed: %v", err)
+		uinit_common.Fail("mkfs", err)
 	}
 
 	_, err = mount.Mount(zramDev, "/root", "xfs", "", 0)
 	if err != nil {
-		log.Fatalf("mount failed: %v", err)
+		uinit_common.Fail("zram mount", err)
 	}
 
 	fmt.Printf("\nRapidos scratch VM running. Have a lot of fun...\n")
+	// failure to report is harmless, e.g. for kernels without virtio_console
+	uinit_common.SendResult(uinit_common.ResultReady, "scratch VM running",
+		nil)
 	// init will exec u-root DefaultShell following uinit completion...
 }
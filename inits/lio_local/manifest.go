@@ -41,6 +41,9 @@ func init() {
 			Bins:  []string{},
 			Files: []string{},
 		},
+		// GetiSCSIConf() in the uinit consumes the following
+		ConfRequired: []string{"TARGET_IQN"},
+		ConfOptional: []string{"INITIATOR_IQNS"},
 		VMResources: rapidos.Resources{
 			Network: true,
 			CPUs:    2,
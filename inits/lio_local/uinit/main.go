@@ -12,6 +12,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -36,63 +37,81 @@ func main() {
 		"iscsi_target_mod"} {
 		err := kmodule.Probe(mod, "")
 		if err != nil {
-			log.Fatalf("failed to load %s kmod: %v", mod, err)
+			uinit_common.Fail("LIO kmod load",
+				fmt.Errorf("%s: %v", mod, err))
 		}
 	}
 
-	zramDev := uinit_common.ProvisionZram(zramDisksize)
+	zramDev, err := uinit_common.ProvisionZram(zramDisksize)
+	if err != nil {
+		uinit_common.Fail("zram provisioning", err)
+	}
 
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
+	}
+	err = uinit_common.SetupIPv6()
+	if err != nil {
+		uinit_common.Fail("IPv6 setup", err)
+	}
+	targetIQN, _, err := uinit_common.GetiSCSIConf(c)
+	if err != nil {
+		uinit_common.Fail("iSCSI conf", err)
 	}
-	uinit_common.EnableDynDebug(c)
-	targetIQN, _ := uinit_common.GetiSCSIConf(c)
 
 	_, err = mount.Mount("configfs", "/sys/kernel/config/", "configfs", "", 0)
 	if err != nil {
-		log.Fatalf("mount failed: %v", err)
+		uinit_common.Fail("configfs mount", err)
 	}
 
 	err = os.MkdirAll(cfsiSCSIPath, 0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 	err = os.MkdirAll("/var/target/pr", 0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsiSCSIPath,
 		"discovery_auth/enforce_discovery_auth"),
 		[]byte("0"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = os.MkdirAll(cfsZramBackstorePath, 0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsZramBackstorePath, "control"),
 		[]byte("udev_path="+zramDev), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	serial := strings.Replace(zramDev, "/", "_", -1)
 
 	err = os.MkdirAll("/var/target/alua/tpgs_"+serial, 0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsZramBackstorePath,
 		"wwn/vpd_unit_serial"),
 		[]byte(serial), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	// ignore failure if UNMAP support can't be enabled
@@ -102,49 +121,49 @@ func main() {
 	err = ioutil.WriteFile(path.Join(cfsZramBackstorePath, "enable"),
 		[]byte("1"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = os.MkdirAll(path.Join(cfsiSCSIPath, targetIQN,
 		"tpgt_0/lun/lun_0"),
 		0755)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = os.Symlink(cfsZramBackstorePath,
 		path.Join(cfsiSCSIPath, targetIQN,
 			"tpgt_0/lun/lun_0/zramo"))
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsiSCSIPath, targetIQN,
 		"tpgt_0/attrib/authentication"),
 		[]byte("0"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsiSCSIPath, targetIQN,
 		"tpgt_0/attrib/demo_mode_write_protect"),
 		[]byte("0"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsiSCSIPath, targetIQN,
 		"tpgt_0/attrib/generate_node_acls"),
 		[]byte("1"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	err = ioutil.WriteFile(path.Join(cfsiSCSIPath, targetIQN,
 		"tpgt_0/param/AuthMethod"),
 		[]byte("CHAP,None"), 0644)
 	if err != nil {
-		log.Fatal(err)
+		uinit_common.Fail("LIO target setup", err)
 	}
 
 	// LIO "demo-mode" dynamically creates acls for connecting initiators
@@ -158,19 +177,21 @@ func main() {
 
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatalf("failed to get network addresses: %v", err)
+		uinit_common.Fail("LIO portal setup", err)
 	}
 	ready := false
 	for _, addr := range addrs {
 		ipnet, ok := addr.(*net.IPNet)
-		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
-			continue // skip loopback and non-V4 addresses
+		if !ok || ipnet.IP.IsLoopback() ||
+			ipnet.IP.IsLinkLocalUnicast() {
+			continue // skip loopback and link-local addresses
 		}
-		ipPort := ipnet.IP.String() + ":3260"
+		// IPv6 portals are bracketed, e.g. [fd00::1]:3260
+		ipPort := net.JoinHostPort(ipnet.IP.String(), "3260")
 		err = os.MkdirAll(path.Join(cfsiSCSIPath, targetIQN,
 			"tpgt_0/np/", ipPort), 0755)
 		if err != nil {
-			log.Fatal(err)
+			uinit_common.Fail("LIO portal setup", err)
 		}
 
 		err = ioutil.WriteFile(path.Join(cfsiSCSIPath, targetIQN,
@@ -181,6 +202,12 @@ func main() {
 		ready = true
 	}
 	if !ready {
-		log.Fatalf("failed to find any IP addresses to listen on\n")
+		uinit_common.Fail("LIO portal setup",
+			fmt.Errorf("failed to find any IP addresses to listen on"))
+	}
+	err = uinit_common.SendResult(uinit_common.ResultReady, "target ready",
+		targetIQN)
+	if err != nil {
+		log.Printf("failed to send ready result: %v\n", err)
 	}
 }
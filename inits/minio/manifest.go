@@ -35,6 +35,8 @@ func init() {
 			Network: true,
 			CPUs:    2,
 			Memory:  "1024M",
+			// minio S3 port, forwarded with NET_MODE="user"
+			Ports: []uint16{9000},
 		},
 	}
 
@@ -12,7 +12,6 @@
 package main
 
 import (
-	"log"
 	"os"
 	"os/exec"
 
@@ -24,30 +23,47 @@ import (
 const zramDisksize = "2G"
 
 func main() {
-	zramDev := uinit_common.ProvisionZram(zramDisksize)
+	zramDev, err := uinit_common.ProvisionZram(zramDisksize)
+	if err != nil {
+		uinit_common.Fail("zram provisioning", err)
+	}
 
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
+	}
+	err = uinit_common.SetupIPv6()
+	if err != nil {
+		uinit_common.Fail("IPv6 setup", err)
 	}
-	uinit_common.EnableDynDebug(c)
 
 	cmd := exec.Command("mkfs.xfs", zramDev)
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		log.Fatalf("mkfs failed: %v", err)
+		uinit_common.Fail("mkfs", err)
 	}
 
 	_, err = mount.Mount(zramDev, "/root", "xfs", "", 0)
 	if err != nil {
-		log.Fatalf("mount failed: %v", err)
+		uinit_common.Fail("zram mount", err)
 	}
 
-	cmd = exec.Command("minio", "server", "/root")
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	err = cmd.Run()
+	err = uinit_common.RunServices([]uinit_common.Service{{
+		Name:    "minio",
+		Cmd:     []string{"minio", "server", "/root"},
+		Ready:   uinit_common.TCPProbe("127.0.0.1:9000"),
+		Restart: uinit_common.RestartOnFailure,
+	}})
 	if err != nil {
-		log.Fatalf("minio failed: %v", err)
+		uinit_common.Fail("services", err)
 	}
 }
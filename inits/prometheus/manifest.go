@@ -35,6 +35,8 @@ func init() {
 			Network: true,
 			CPUs:    2,
 			Memory:  "512M",
+			// prometheus web port, forwarded with NET_MODE="user"
+			Ports: []uint16{9090},
 		},
 	}
 
@@ -13,9 +13,6 @@ package main
 
 import (
 	"io/ioutil"
-	"log"
-	"os"
-	"os/exec"
 
 	"gitlab.com/rapidos/rapidos/inits/uinit_common"
 )
@@ -45,20 +42,34 @@ scrape_configs:
 func main() {
 	c, err := uinit_common.ReadConfGob()
 	if err != nil {
-		log.Fatalf("failed to parse conf %v\n", err)
+		uinit_common.Fail("conf parsing", err)
+	}
+	err = uinit_common.EnableDynDebug(c)
+	if err != nil {
+		uinit_common.Fail("dynamic debug setup", err)
+	}
+	err = uinit_common.StartWatchdog(c)
+	if err != nil {
+		uinit_common.Fail("watchdog setup", err)
+	}
+	err = uinit_common.SetupIPv6()
+	if err != nil {
+		uinit_common.Fail("IPv6 setup", err)
 	}
-	uinit_common.EnableDynDebug(c)
 
 	// TODO support arbitrary prometheus configs via rapidos.conf
 	err = ioutil.WriteFile("prometheus.yml", []byte(yml), 0644)
 	if err != nil {
-		log.Fatalf("failed to write conf %v\n", err)
+		uinit_common.Fail("prometheus.yml setup", err)
 	}
 
-	cmd := exec.Command("prometheus", "--config.file=prometheus.yml")
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	err = cmd.Run()
+	err = uinit_common.RunServices([]uinit_common.Service{{
+		Name:    "prometheus",
+		Cmd:     []string{"prometheus", "--config.file=prometheus.yml"},
+		Ready:   uinit_common.TCPProbe("127.0.0.1:9090"),
+		Restart: uinit_common.RestartOnFailure,
+	}})
 	if err != nil {
-		log.Fatalf("minio failed: %v", err)
+		uinit_common.Fail("services", err)
 	}
 }
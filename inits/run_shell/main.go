@@ -0,0 +1,40 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+// run_shell is the u-root DefaultShell for all rapidos images, so is started by
+// init following uinit completion. It runs any rapidos -run command and powers
+// off the VM, otherwise it execs the interactive shell.
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"gitlab.com/rapidos/rapidos/inits/uinit_common"
+)
+
+const interactiveShell = "/bbin/rush"
+
+func main() {
+	runCmd, err := uinit_common.GetRunCmd()
+	if err != nil {
+		uinit_common.Fail("run command parsing", err)
+	}
+	if runCmd != "" {
+		uinit_common.RunAndPowerOff(runCmd)
+	}
+
+	err = syscall.Exec(interactiveShell, []string{interactiveShell},
+		os.Environ())
+	fmt.Fprintf(os.Stderr, "failed to exec %s: %v\n", interactiveShell, err)
+	os.Exit(1)
+}
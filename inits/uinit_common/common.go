@@ -14,14 +14,21 @@ package uinit_common
 import (
 	"bufio"
 	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"path"
+	"sort"
+	"strconv"
+	"syscall"
 
 	"github.com/u-root/u-root/pkg/kmodule"
 	"github.com/u-root/u-root/pkg/mount"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/rtnl"
 )
 
 const (
@@ -33,6 +40,8 @@ type RapidosConfMap struct {
 	f map[string]string
 }
 
+// The embedded conf only carries the keys declared by the manifest via
+// ConfRequired / ConfOptional, alongside globals such as DYN_DEBUG_MODULES.
 func ReadConfGob() (*RapidosConfMap, error) {
 	var conf = new(RapidosConfMap)
 
@@ -53,14 +62,14 @@ func ReadConfGob() (*RapidosConfMap, error) {
 
 // enable kernel dynamic debug if configured in rapidos.conf
 // should be called after loading all kernel modules
-func EnableDynDebug(conf *RapidosConfMap) {
+func EnableDynDebug(conf *RapidosConfMap) error {
 	const dynDebugCtrlPath = "/sys/kernel/debug/dynamic_debug/control"
 
 	_, err := os.Stat(dynDebugCtrlPath)
 	if os.IsNotExist(err) {
 		_, err = mount.Mount("debugfs", "/sys/kernel/debug/", "debugfs", "", 0)
 		if err != nil {
-			log.Fatalf("mount failed: %v", err)
+			return fmt.Errorf("debugfs mount failed: %v", err)
 		}
 	}
 
@@ -68,53 +77,57 @@ func EnableDynDebug(conf *RapidosConfMap) {
 		err = ioutil.WriteFile(dynDebugCtrlPath,
 			[]byte("module "+mod+" +pf"), 0644)
 		if err != nil {
-			log.Fatalf("failed to enable dynamic debug: %v", err)
+			return fmt.Errorf("failed to enable dynamic debug for "+
+				"module %s: %v", mod, err)
 		}
 	}
 	for _, f := range strings.Fields(conf.f["DYN_DEBUG_FILES"]) {
 		err = ioutil.WriteFile(dynDebugCtrlPath,
 			[]byte("file "+f+" +pf"), 0644)
 		if err != nil {
-			log.Fatalf("failed to enable dynamic debug: %v", err)
+			return fmt.Errorf("failed to enable dynamic debug for "+
+				"file %s: %v", f, err)
 		}
 	}
+	return nil
 }
 
-func ProvisionZram(disksize string) string {
-	err := kmodule.Probe("lzo", "")
-	if err != nil {
-		log.Fatalf("failed to load lzo kmod: %v", err)
-	}
-	err = kmodule.Probe("lzo-rle", "")
-	if err != nil {
-		log.Fatalf("failed to load lzo-rle kmod: %v", err)
+// load zram and hot-add a device of @disksize, returning the device path
+func ProvisionZram(disksize string) (string, error) {
+	for _, mod := range []string{"lzo", "lzo-rle"} {
+		err := kmodule.Probe(mod, "")
+		if err != nil {
+			return "", fmt.Errorf("failed to load %s kmod: %v",
+				mod, err)
+		}
 	}
-	err = kmodule.Probe("zram", "num_devices=0")
+	err := kmodule.Probe("zram", "num_devices=0")
 	if err != nil {
-		log.Fatalf("failed to load zram kmod: %v", err)
+		return "", fmt.Errorf("failed to load zram kmod: %v", err)
 	}
 	zIdx, err := ioutil.ReadFile("/sys/class/zram-control/hot_add")
 	if err != nil {
-		log.Fatalf("failed to hot-add zram device: %v", err)
+		return "", fmt.Errorf("failed to hot-add zram device: %v", err)
 	}
 	zramName := "zram" + strings.TrimSpace(string(zIdx))
 	err = ioutil.WriteFile("/sys/block/"+zramName+"/disksize",
 		[]byte(disksize), 0644)
 	if err != nil {
-		log.Fatalf("failed to write %s disksize: %v", zramName, err)
+		return "", fmt.Errorf("failed to write %s disksize: %v",
+			zramName, err)
 	}
 
-	return "/dev/" + zramName
+	return "/dev/" + zramName, nil
 }
 
-func GetiSCSIConf(conf *RapidosConfMap) (string, []string) {
+func GetiSCSIConf(conf *RapidosConfMap) (string, []string, error) {
 	if conf.f["TARGET_IQN"] == "" {
-		log.Fatalf("error: TARGET_IQN missing in rapidos.conf\n")
+		return "", nil, fmt.Errorf("TARGET_IQN missing in rapidos.conf")
 	}
-
 	// missing INITIATOR_IQNS config is not an error
 
-	return conf.f["TARGET_IQN"], strings.Fields(conf.f["INITIATOR_IQNS"])
+	return conf.f["TARGET_IQN"], strings.Fields(conf.f["INITIATOR_IQNS"]),
+		nil
 }
 
 type CifsOpts struct {
@@ -138,18 +151,151 @@ func GetCifsOpts(conf *RapidosConfMap) CifsOpts {
 	}
 }
 
-func GetDirPath(conf *RapidosConfMap, key string) (string) {
+func GetDirPath(conf *RapidosConfMap, key string) (string, error) {
 	val := conf.f[key]
 	if len(val) == 0 {
-		log.Fatalf("%s not configured", key)
+		return "", fmt.Errorf("%s not configured", key)
 	}
 	stat, err := os.Stat(val)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return "", err
 	}
 	if !stat.IsDir() {
-		log.Fatalf("%s is not a directory", val)
+		return "", fmt.Errorf("%s is not a directory", val)
+	}
+
+	return path.Clean(val), nil
+}
+
+// VMDef carries the hostname and static addresses of a rapidos.conf VM
+// definition, as embedded for manifests with ConfVMDefs set.
+type VMDef struct {
+	Index    int
+	Hostname string
+	// optional, without prefix length
+	IPAddr  string
+	IP6Addr string
+}
+
+// Return all embedded VM definitions, sorted by index
+func GetVMDefs(conf *RapidosConfMap) []VMDef {
+	var vmDefs []VMDef
+
+	for key, hostname := range conf.f {
+		if !strings.HasPrefix(key, "HOSTNAME") {
+			continue
+		}
+		vmIndex, err := strconv.Atoi(strings.TrimPrefix(key, "HOSTNAME"))
+		if err != nil || vmIndex < 1 {
+			continue
+		}
+		vmDefs = append(vmDefs, VMDef{
+			Index:    vmIndex,
+			Hostname: hostname,
+			IPAddr:   conf.f["IP_ADDR"+strconv.Itoa(vmIndex)],
+			IP6Addr:  conf.f["IP6_ADDR"+strconv.Itoa(vmIndex)],
+		})
+	}
+
+	sort.Slice(vmDefs, func(i, j int) bool {
+		return vmDefs[i].Index < vmDefs[j].Index
+	})
+	return vmDefs
+}
+
+// kernel parameter listing the VM indices booted together via rapidos -cluster
+const clusterParam = "rapidos.cluster"
+
+func parseClusterVMs(cmdline string) ([]int, error) {
+	var vmIndices []int
+	for _, param := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(param, clusterParam+"=") {
+			continue
+		}
+		val := strings.TrimPrefix(param, clusterParam+"=")
+		for _, s := range strings.Split(val, ",") {
+			vmIndex, err := strconv.Atoi(s)
+			if err != nil || vmIndex < 1 {
+				return nil, fmt.Errorf("invalid %s parameter: %s",
+					clusterParam, val)
+			}
+			vmIndices = append(vmIndices, vmIndex)
+		}
+	}
+	return vmIndices, nil
+}
+
+// GetClusterVMs returns the indices of all VMs booted alongside this one via
+// rapidos -cluster, or nil if the VM was booted on its own.
+func GetClusterVMs() ([]int, error) {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterVMs(string(cmdline))
+}
+
+// Configure IPv6 addressing (and the hostname, if the kernel didn't) as
+// provided by rapidos via rapidos.ip6=, rapidos.gw6= and rapidos.hostname=
+// kernel parameters. The kernel only handles IPv4 via ip=.
+func SetupIPv6() error {
+	const netDev = "eth0"
+
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return fmt.Errorf("failed to read kernel cmdline: %v", err)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Fields(string(cmdline)) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], "rapidos.") {
+			params[kv[0]] = kv[1]
+		}
 	}
 
-	return path.Clean(val)
+	if hostname := params["rapidos.hostname"]; hostname != "" {
+		err = syscall.Sethostname([]byte(hostname))
+		if err != nil {
+			return fmt.Errorf("failed to set hostname: %v", err)
+		}
+	}
+
+	if params["rapidos.ip6"] == "" {
+		return nil
+	}
+	ip, ipNet, err := net.ParseCIDR(params["rapidos.ip6"])
+	if err != nil {
+		return fmt.Errorf("invalid rapidos.ip6: %v", err)
+	}
+	ipNet.IP = ip
+
+	c, err := rtnl.Dial()
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	defer c.Close()
+
+	// ip=none leaves the device down
+	err = c.LinkSetUp(netDev, true)
+	if err != nil {
+		return fmt.Errorf("failed to bring up %s: %v", netDev, err)
+	}
+	err = c.AddrAdd(netDev, ipNet)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to %s: %v", ipNet, netDev,
+			err)
+	}
+	if params["rapidos.gw6"] != "" {
+		gw := net.ParseIP(params["rapidos.gw6"])
+		if gw == nil {
+			return fmt.Errorf("invalid rapidos.gw6: %s",
+				params["rapidos.gw6"])
+		}
+		err = c.RouteAddDefault(netDev, gw)
+		if err != nil {
+			return fmt.Errorf("failed to add IPv6 gateway: %v", err)
+		}
+	}
+	log.Printf("configured %s with %s\n", netDev, ipNet)
+	return nil
 }
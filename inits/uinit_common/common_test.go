@@ -0,0 +1,38 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClusterVMs(t *testing.T) {
+	vmIndices, err := parseClusterVMs("console=ttyS0 rapidos.cluster=2,3 " +
+		"quiet\n")
+	if err != nil || !reflect.DeepEqual(vmIndices, []int{2, 3}) {
+		t.Errorf("unexpected cluster VMs %v: %v", vmIndices, err)
+	}
+
+	vmIndices, err = parseClusterVMs("console=ttyS0 ip=none\n")
+	if err != nil || vmIndices != nil {
+		t.Errorf("unexpected cluster VMs %v: %v", vmIndices, err)
+	}
+
+	for _, cmdline := range []string{"rapidos.cluster=", "rapidos.cluster=1,x",
+		"rapidos.cluster=0"} {
+		_, err = parseClusterVMs(cmdline)
+		if err == nil {
+			t.Errorf("%s: expected error", cmdline)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// FailExitCode is the uinit exit status following Fail(). If the VM is powered
+// off due to UINIT_FAIL_POWEROFF, then x86_64 QEMU also exits with this status.
+const FailExitCode = 33
+
+const (
+	// isa-debug-exit device provided by rapidos for x86_64 VMs. QEMU exits
+	// with status (<value> << 1) | 1 when written to.
+	debugExitPort = 0xf4
+	// number of kernel log lines to dump on failure
+	dmesgTailLines = 30
+
+	syslogActionReadAll    = 3
+	syslogActionSizeBuffer = 10
+)
+
+func dumpDmesgTail() {
+	size, err := syscall.Klogctl(syslogActionSizeBuffer, nil)
+	if err != nil || size <= 0 {
+		fmt.Fprintf(os.Stderr, "failed to get kernel log size: %v\n",
+			err)
+		return
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Klogctl(syslogActionReadAll, buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read kernel log: %v\n", err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+	if len(lines) > dmesgTailLines {
+		lines = lines[len(lines)-dmesgTailLines:]
+	}
+	fmt.Fprintf(os.Stderr, "--- dmesg (last %d lines) ---\n%s\n",
+		len(lines), strings.Join(lines, "\n"))
+}
+
+func dumpMounts() {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read mounts: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "--- mounts ---\n%s", mounts)
+}
+
+// power off the VM, using the QEMU isa-debug-exit device where available so
+// that QEMU's exit status reflects the failure
+func failPowerOff() {
+	syscall.Sync()
+	if runtime.GOARCH == "amd64" {
+		// writes to /dev/port offsets are performed as port I/O
+		f, err := os.OpenFile("/dev/port", os.O_WRONLY, 0)
+		if err == nil {
+			f.WriteAt([]byte{FailExitCode >> 1}, debugExitPort)
+			f.Close()
+		}
+	}
+	// only reached if QEMU lacks the isa-debug-exit device
+	err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	fmt.Fprintf(os.Stderr, "power off failed: %v\n", err)
+}
+
+// Fail reports the failure of uinit @step with @err to the console and rapidos
+// host, alongside the kernel log tail and mounts to aid diagnosis. The VM is
+// then powered off if UINIT_FAIL_POWEROFF="1" is set in rapidos.conf or if
+// booted via rapidos -run, otherwise the uinit exits with FailExitCode,
+// leaving init to start the shell.
+func Fail(step string, err error) {
+	fmt.Fprintf(os.Stderr, "\nrapidos uinit failed at %s: %v\n", step, err)
+	serr := SendResult(ResultFailed, fmt.Sprintf("%s: %v", step, err), nil)
+	if serr != nil {
+		fmt.Fprintf(os.Stderr, "failed to report failure to host: %v\n",
+			serr)
+	}
+	dumpDmesgTail()
+	dumpMounts()
+	fmt.Fprintf(os.Stderr, "--- end of failure report for %s ---\n", step)
+
+	// may be called before (or due to failure of) ReadConfGob()
+	conf, cerr := ReadConfGob()
+	if cerr == nil && conf.f["UINIT_FAIL_POWEROFF"] == "1" {
+		failPowerOff()
+	}
+	// nobody is around to use the shell
+	if runCmd, _ := GetRunCmd(); runCmd != "" {
+		failPowerOff()
+	}
+	os.Exit(FailExitCode)
+}
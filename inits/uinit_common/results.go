@@ -0,0 +1,121 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/kmodule"
+)
+
+// virtio-serial port name provided by rapidos, which must match the host
+const resultsPortName = "org.rapidos.results"
+
+// result events understood by rapidos on the host
+const (
+	// uinit setup has completed, and any services are ready
+	ResultReady = "ready"
+	// uinit failed. rapidos -boot exits non-zero if reported.
+	ResultFailed = "failed"
+	// arbitrary output, e.g. from a test run
+	ResultOutput = "output"
+	// rapidos -run command completed, with RunStatus data
+	ResultExit = "exit"
+)
+
+// Result is a structured event sent from the uinit to the rapidos host
+type Result struct {
+	Event   string      `json:"event"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// locate the results port device via sysfs, creating the device node if
+// devtmpfs hasn't already
+func findResultsPort() (string, error) {
+	// may be builtin, or missing from the image
+	kmodule.Probe("virtio_console", "")
+
+	namePaths, err := filepath.Glob("/sys/class/virtio-ports/*/name")
+	if err != nil {
+		return "", err
+	}
+	for _, namePath := range namePaths {
+		name, err := ioutil.ReadFile(namePath)
+		if err != nil ||
+			strings.TrimSpace(string(name)) != resultsPortName {
+			continue
+		}
+
+		portDir := path.Dir(namePath)
+		devPath := path.Join("/dev", path.Base(portDir))
+		_, err = os.Stat(devPath)
+		if err == nil {
+			return devPath, nil
+		}
+		var major, minor uint32
+		dev, err := ioutil.ReadFile(path.Join(portDir, "dev"))
+		if err != nil {
+			return "", err
+		}
+		_, err = fmt.Sscanf(string(dev), "%d:%d", &major, &minor)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s dev: %v", portDir, err)
+		}
+		err = syscall.Mknod(devPath, syscall.S_IFCHR|0600,
+			int(major<<8|minor&0xff|(minor&^0xff)<<12))
+		if err != nil {
+			return "", err
+		}
+		return devPath, nil
+	}
+	return "", fmt.Errorf("virtio-serial port %s not found", resultsPortName)
+}
+
+func writeResult(w io.Writer, r Result) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// SendResult sends @event to the rapidos host, alongside an optional
+// @message and JSON encodable @data.
+func SendResult(event string, message string, data interface{}) error {
+	devPath, err := findResultsPort()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(devPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeResult(f, Result{Event: event, Message: message,
+		Data: data})
+}
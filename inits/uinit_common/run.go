@@ -0,0 +1,104 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// kernel parameter carrying the base64 encoded rapidos -run command
+const runParam = "rapidos.run"
+
+// RunStatus is sent as ResultExit data following completion of the -run
+// command.
+type RunStatus struct {
+	Status int `json:"status"`
+}
+
+func parseRunCmd(cmdline string) (string, error) {
+	for _, param := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(param, runParam+"=") {
+			continue
+		}
+		cmd, err := base64.RawURLEncoding.DecodeString(
+			strings.TrimPrefix(param, runParam+"="))
+		if err != nil {
+			return "", fmt.Errorf("invalid %s parameter: %v",
+				runParam, err)
+		}
+		return string(cmd), nil
+	}
+	return "", nil
+}
+
+// GetRunCmd returns the command provided via rapidos -run, or an empty string
+// if the VM was booted interactively.
+func GetRunCmd() (string, error) {
+	cmdline, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", err
+	}
+	return parseRunCmd(string(cmdline))
+}
+
+// RunCmd runs @cmd via sh, if present in the image, otherwise it is split on
+// whitespace and executed directly. Output goes to the console. The exit status
+// is returned, with 127 indicating that @cmd couldn't be started.
+func RunCmd(cmd string) int {
+	var c *exec.Cmd
+	if _, err := exec.LookPath("sh"); err == nil {
+		c = exec.Command("sh", "-c", cmd)
+	} else {
+		args := strings.Fields(cmd)
+		if len(args) == 0 {
+			return 0
+		}
+		c = exec.Command(args[0], args[1:]...)
+	}
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	err := c.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok &&
+			ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run %q: %v\n", cmd, err)
+		return 127
+	}
+	return 0
+}
+
+// RunAndPowerOff runs the rapidos -run @cmd, reports its exit status to the
+// host and then powers off the VM.
+func RunAndPowerOff(cmd string) {
+	fmt.Printf("\nrapidos running: %s\n", cmd)
+	status := RunCmd(cmd)
+	fmt.Printf("rapidos run completed with status %d\n", status)
+
+	err := SendResult(ResultExit, cmd, RunStatus{Status: status})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to report run status: %v\n", err)
+	}
+	syscall.Sync()
+	err = syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	fmt.Fprintf(os.Stderr, "power off failed: %v\n", err)
+	os.Exit(status)
+}
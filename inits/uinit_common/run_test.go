@@ -0,0 +1,55 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"testing"
+)
+
+func TestParseRunCmd(t *testing.T) {
+	// encoded by the host via base64.RawURLEncoding
+	cmd, err := parseRunCmd("console=ttyS0 ip=none " +
+		"rapidos.run=ZWNobyAnaGknICYmIGV4aXQgMw quiet\n")
+	if err != nil || cmd != "echo 'hi' && exit 3" {
+		t.Errorf("unexpected run command %q: %v", cmd, err)
+	}
+
+	cmd, err = parseRunCmd("console=ttyS0 ip=none\n")
+	if err != nil || cmd != "" {
+		t.Errorf("unexpected run command %q: %v", cmd, err)
+	}
+
+	_, err = parseRunCmd("rapidos.run=!!")
+	if err == nil {
+		t.Errorf("expected error for invalid encoding")
+	}
+}
+
+func TestRunCmd(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		status int
+	}{
+		{"true", 0},
+		{"exit 3", 3},
+		{"kill -9 $$", 128 + 9},
+		{"/nonexistent/rapidos", 127},
+	}
+
+	for _, test := range tests {
+		status := RunCmd(test.cmd)
+		if status != test.status {
+			t.Errorf("%q: got status %d, expected %d", test.cmd,
+				status, test.status)
+		}
+	}
+}
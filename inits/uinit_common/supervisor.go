@@ -0,0 +1,518 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// RestartPolicy determines whether a service is restarted once it exits
+type RestartPolicy int
+
+const (
+	RestartNever RestartPolicy = iota
+	RestartOnFailure
+	RestartAlways
+)
+
+const (
+	defaultReadyTimeout = time.Duration(10 * time.Second)
+	probeInterval       = time.Duration(200 * time.Millisecond)
+	restartDelay        = time.Duration(time.Second)
+	// give up on services which keep exiting
+	maxRestarts = 5
+)
+
+// Probe returns true once a service is ready for use
+type Probe func() bool
+
+// TCPProbe considers a service ready once @addr accepts connections
+func TCPProbe(addr string) Probe {
+	return func() bool {
+		conn, err := net.DialTimeout("tcp", addr,
+			time.Duration(time.Second))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+}
+
+// FileProbe considers a service ready once @path exists
+func FileProbe(path string) Probe {
+	return func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+}
+
+// CmdProbe considers a service ready once @name @args exits successfully
+func CmdProbe(name string, args ...string) Probe {
+	return func() bool {
+		return exec.Command(name, args...).Run() == nil
+	}
+}
+
+// Service declares a process to be run by a Supervisor
+type Service struct {
+	Name string
+	// command and arguments
+	Cmd []string
+	// added to the uinit environment, as "<KEY>=<val>"
+	Env []string
+	// optional readiness check, polled after each start. Services
+	// without one are considered ready once started.
+	Ready Probe
+	// defaults to 10 seconds
+	ReadyTimeout time.Duration
+	// oneshot services are expected to run to completion, e.g. setup
+	// steps, and are considered ready once they've exited successfully
+	Oneshot bool
+	// names of services which must be ready before this one is started
+	Deps    []string
+	Restart RestartPolicy
+}
+
+type ServiceState int
+
+const (
+	ServicePending ServiceState = iota
+	ServiceStarting
+	ServiceReady
+	ServiceRestarting
+	// exited successfully and not restarted
+	ServiceExited
+	ServiceFailed
+)
+
+var serviceStateNames = []string{"pending", "starting", "ready",
+	"restarting", "exited", "failed"}
+
+func (st ServiceState) String() string {
+	if st < 0 || int(st) >= len(serviceStateNames) {
+		return fmt.Sprintf("ServiceState(%d)", int(st))
+	}
+	return serviceStateNames[st]
+}
+
+// ServiceStatus is a snapshot of a supervised service
+type ServiceStatus struct {
+	Name     string
+	State    ServiceState
+	Pid      int
+	Restarts int
+}
+
+type service struct {
+	Service
+	status ServiceStatus
+	proc   *os.Process
+	// runner goroutine has been launched
+	started bool
+	// has been ready (or exited) at least once, so dependents can run
+	available bool
+}
+
+type svcEvent struct {
+	svc   *service
+	state ServiceState
+	proc  *os.Process
+	err   error
+}
+
+// Supervisor runs a set of services in dependency order
+type Supervisor struct {
+	// optional, called once all services are first ready
+	OnReady func([]ServiceStatus)
+
+	services []*service
+	events   chan svcEvent
+	// closed once Run returns
+	stop  chan struct{}
+	mutex sync.Mutex
+}
+
+var errReadyTimeout = errors.New("timeout waiting for service to be ready")
+
+// NewSupervisor checks @svcs for missing or cyclic dependencies, and returns
+// a Supervisor ready to Run() them.
+func NewSupervisor(svcs []Service) (*Supervisor, error) {
+	sv := &Supervisor{
+		events: make(chan svcEvent),
+		stop:   make(chan struct{}),
+	}
+	byName := make(map[string]*service)
+
+	for _, s := range svcs {
+		if s.Name == "" || len(s.Cmd) == 0 {
+			return nil, fmt.Errorf("service %q missing name or command",
+				s.Name)
+		}
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate service %s", s.Name)
+		}
+		if s.Oneshot && s.Restart == RestartAlways {
+			return nil, fmt.Errorf("oneshot service %s can't be "+
+				"always restarted", s.Name)
+		}
+		if s.ReadyTimeout == 0 {
+			s.ReadyTimeout = defaultReadyTimeout
+		}
+		svc := &service{Service: s}
+		svc.status.Name = s.Name
+		byName[s.Name] = svc
+		sv.services = append(sv.services, svc)
+	}
+
+	for _, svc := range sv.services {
+		for _, dep := range svc.Deps {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("service %s has unknown "+
+					"dependency %s", svc.Name, dep)
+			}
+		}
+	}
+
+	// depth first search for cycles. visiting services are on the stack.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("service %s has cyclic dependencies",
+				name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dep := range byName[name].Deps {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	for _, svc := range sv.services {
+		err := visit(svc.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sv, nil
+}
+
+// send an event to Run(), unless it has already returned
+func (sv *Supervisor) send(ev svcEvent) bool {
+	select {
+	case sv.events <- ev:
+		return true
+	case <-sv.stop:
+		return false
+	}
+}
+
+// wait for @svc to become ready. If the process exits first, false is
+// returned alongside its exit status. On timeout the process is killed.
+func waitReady(svc *service, proc *os.Process,
+	exited <-chan error) (bool, error) {
+	deadline := time.After(svc.ReadyTimeout)
+	for {
+		if svc.Ready == nil || svc.Ready() {
+			return true, nil
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exited before becoming ready")
+			}
+			return false, err
+		case <-deadline:
+			proc.Kill()
+			<-exited
+			return false, errReadyTimeout
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// start, and restart as needed, @svc. Runs in its own goroutine.
+func (sv *Supervisor) supervise(svc *service) {
+	restarts := 0
+	for {
+		cmd := exec.Command(svc.Cmd[0], svc.Cmd[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), svc.Env...)
+		err := cmd.Start()
+		if err != nil {
+			sv.send(svcEvent{svc: svc, state: ServiceFailed,
+				err: err})
+			return
+		}
+		if !sv.send(svcEvent{svc: svc, state: ServiceStarting,
+			proc: cmd.Process}) {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return
+		}
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		if svc.Oneshot {
+			err = <-exited
+		} else {
+			var ready bool
+			ready, err = waitReady(svc, cmd.Process, exited)
+			if err == errReadyTimeout {
+				sv.send(svcEvent{svc: svc, state: ServiceFailed,
+					err: err})
+				return
+			}
+			if ready {
+				if !sv.send(svcEvent{svc: svc,
+					state: ServiceReady}) {
+					return
+				}
+				err = <-exited
+			}
+		}
+
+		if err == nil && (svc.Oneshot || svc.Restart != RestartAlways) {
+			sv.send(svcEvent{svc: svc, state: ServiceExited})
+			return
+		}
+		if svc.Restart == RestartNever {
+			sv.send(svcEvent{svc: svc, state: ServiceFailed,
+				err: err})
+			return
+		}
+		if restarts >= maxRestarts {
+			sv.send(svcEvent{svc: svc, state: ServiceFailed,
+				err: fmt.Errorf("giving up after %d restarts: %v",
+					restarts, err)})
+			return
+		}
+		restarts++
+		if !sv.send(svcEvent{svc: svc, state: ServiceRestarting,
+			err: err}) {
+			return
+		}
+		select {
+		case <-time.After(restartDelay):
+		case <-sv.stop:
+			return
+		}
+	}
+}
+
+// launch any services with all dependencies available
+func (sv *Supervisor) startAvailable() {
+	byName := make(map[string]*service)
+	for _, svc := range sv.services {
+		byName[svc.Name] = svc
+	}
+
+	for _, svc := range sv.services {
+		if svc.started {
+			continue
+		}
+		depsAvail := true
+		for _, dep := range svc.Deps {
+			if !byName[dep].available {
+				depsAvail = false
+				break
+			}
+		}
+		if depsAvail {
+			svc.started = true
+			go sv.supervise(svc)
+		}
+	}
+}
+
+// update state for @ev, returning an error if the service failed
+func (sv *Supervisor) handle(ev svcEvent) error {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	svc := ev.svc
+	svc.status.State = ev.state
+	switch ev.state {
+	case ServiceStarting:
+		svc.proc = ev.proc
+		svc.status.Pid = ev.proc.Pid
+		log.Printf("service %s: %v (pid %d)\n", svc.Name, ev.state,
+			svc.status.Pid)
+		return nil
+	case ServiceReady:
+		svc.available = true
+	case ServiceRestarting:
+		svc.status.Restarts++
+		svc.status.Pid = 0
+		svc.proc = nil
+		log.Printf("service %s: %v after exit: %v\n", svc.Name,
+			ev.state, ev.err)
+		return nil
+	case ServiceExited:
+		svc.available = true
+		svc.status.Pid = 0
+		svc.proc = nil
+	case ServiceFailed:
+		svc.status.Pid = 0
+		svc.proc = nil
+		if ev.err == nil {
+			ev.err = fmt.Errorf("exited unexpectedly")
+		}
+		return fmt.Errorf("service %s failed: %v", svc.Name, ev.err)
+	}
+	log.Printf("service %s: %v\n", svc.Name, ev.state)
+	return nil
+}
+
+func (sv *Supervisor) allAvailable() bool {
+	for _, svc := range sv.services {
+		if !svc.available {
+			return false
+		}
+	}
+	return true
+}
+
+func (sv *Supervisor) allExited() bool {
+	for _, svc := range sv.services {
+		if svc.status.State != ServiceExited {
+			return false
+		}
+	}
+	return true
+}
+
+// kill any running services, following failure
+func (sv *Supervisor) killAll() {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	for _, svc := range sv.services {
+		if svc.proc != nil {
+			svc.proc.Kill()
+		}
+	}
+}
+
+// Run starts each service once its dependencies are ready, and supervises
+// them until they've all exited. If any service fails, the remaining
+// services are killed and an error returned.
+func (sv *Supervisor) Run() error {
+	defer close(sv.stop)
+
+	readyCalled := false
+	sv.startAvailable()
+	for {
+		err := sv.handle(<-sv.events)
+		if err != nil {
+			sv.killAll()
+			return err
+		}
+		if !readyCalled && sv.allAvailable() {
+			readyCalled = true
+			if sv.OnReady != nil {
+				sv.OnReady(sv.Status())
+			}
+		}
+		if sv.allExited() {
+			return nil
+		}
+		sv.startAvailable()
+	}
+}
+
+// Status returns the current status of each service, in declaration order
+func (sv *Supervisor) Status() []ServiceStatus {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	var status []ServiceStatus
+	for _, svc := range sv.services {
+		status = append(status, svc.status)
+	}
+	return status
+}
+
+// RunServices supervises @svcs until they've all exited, or any fail. With
+// long running services it therefore doesn't return, so neither does the
+// calling uinit, and the u-root default shell (run_shell) is never started.
+// Instead, the rapidos host is sent a ResultReady event once all services are
+// ready, at which point any rapidos -run command is started alongside them.
+// The VM is powered off once the command completes.
+func RunServices(svcs []Service) error {
+	runCmd, err := GetRunCmd()
+	if err != nil {
+		return err
+	}
+	return runServices(svcs, runCmd, RunAndPowerOff)
+}
+
+// RunServices() with the -run command @runCmd started via @run, which doesn't
+// return outside of tests
+func runServices(svcs []Service, runCmd string, run func(string)) error {
+	sv, err := NewSupervisor(svcs)
+	if err != nil {
+		return fmt.Errorf("invalid services: %v", err)
+	}
+	runStarted := false
+	runDone := make(chan struct{})
+	sv.OnReady = func(status []ServiceStatus) {
+		err := SendResult(ResultReady, "all services ready", status)
+		if err != nil {
+			log.Printf("failed to send ready result: %v\n", err)
+		}
+		if runCmd == "" {
+			return
+		}
+		// run alongside long running services, otherwise the command
+		// is run by the default shell once the uinit returns
+		for _, st := range status {
+			if st.State == ServiceReady {
+				runStarted = true
+				go func() {
+					run(runCmd)
+					close(runDone)
+				}()
+				return
+			}
+		}
+	}
+	err = sv.Run()
+	if err == nil && runStarted {
+		// services exited early, so wait for the -run command
+		<-runDone
+	}
+	return err
+}
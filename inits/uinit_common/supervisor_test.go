@@ -0,0 +1,234 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupervisorInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		svcs []Service
+	}{
+		{
+			name: "unknown dependency",
+			svcs: []Service{{Name: "a", Cmd: []string{"true"},
+				Deps: []string{"b"}}},
+		},
+		{
+			name: "duplicate",
+			svcs: []Service{{Name: "a", Cmd: []string{"true"}},
+				{Name: "a", Cmd: []string{"true"}}},
+		},
+		{
+			name: "cycle",
+			svcs: []Service{
+				{Name: "a", Cmd: []string{"true"},
+					Deps: []string{"c"}},
+				{Name: "b", Cmd: []string{"true"},
+					Deps: []string{"a"}},
+				{Name: "c", Cmd: []string{"true"},
+					Deps: []string{"b"}},
+			},
+		},
+		{
+			name: "missing command",
+			svcs: []Service{{Name: "a"}},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := NewSupervisor(test.svcs)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestSupervisorOrdering(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	readyPath := path.Join(tmpDir, "ready")
+	donePath := path.Join(tmpDir, "done")
+
+	// declared in reverse order, so startup must follow dependencies
+	sv, err := NewSupervisor([]Service{
+		{
+			Name:    "check",
+			Cmd:     []string{"test", "-f", readyPath},
+			Oneshot: true,
+			Deps:    []string{"daemon"},
+		},
+		{
+			// becomes ready once the setup file has been copied
+			Name: "daemon",
+			Cmd: []string{"sh", "-c", "sleep 0.2; cp $SRC $DST; " +
+				"while ! test -f " + donePath + "; do sleep 0.1; done"},
+			Env:   []string{"DST=" + readyPath},
+			Ready: FileProbe(readyPath),
+			Deps:  []string{"setup"},
+		},
+		{
+			Name:    "setup",
+			Cmd:     []string{"sh", "-c", "echo > $SRC"},
+			Oneshot: true,
+		},
+		{
+			Name:    "finish",
+			Cmd:     []string{"touch", donePath},
+			Oneshot: true,
+			Deps:    []string{"check"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+	os.Setenv("SRC", path.Join(tmpDir, "src"))
+	defer os.Unsetenv("SRC")
+	readyCalls := 0
+	sv.OnReady = func(status []ServiceStatus) {
+		readyCalls++
+	}
+
+	err = sv.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if readyCalls != 1 {
+		t.Errorf("OnReady called %d times", readyCalls)
+	}
+	for _, st := range sv.Status() {
+		if st.State != ServiceExited || st.Restarts != 0 {
+			t.Errorf("unexpected status: %+v", st)
+		}
+	}
+}
+
+func TestSupervisorFailure(t *testing.T) {
+	sv, err := NewSupervisor([]Service{
+		{Name: "sleeper", Cmd: []string{"sleep", "10"}},
+		{Name: "fails", Cmd: []string{"false"}, Oneshot: true},
+	})
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+
+	err = sv.Run()
+	if err == nil || !strings.Contains(err.Error(), "fails") {
+		t.Fatalf("unexpected Run result: %v", err)
+	}
+}
+
+func TestSupervisorReadyTimeout(t *testing.T) {
+	sv, err := NewSupervisor([]Service{{
+		Name:         "never-ready",
+		Cmd:          []string{"sleep", "10"},
+		Ready:        FileProbe("/nonexistent/rapidos"),
+		ReadyTimeout: time.Duration(300 * time.Millisecond),
+	}})
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+
+	start := time.Now()
+	err = sv.Run()
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("unexpected Run result: %v", err)
+	}
+	if time.Since(start) > time.Duration(5*time.Second) {
+		t.Errorf("service not killed on ready timeout")
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	markerPath := path.Join(tmpDir, "marker")
+
+	// fails on first run only
+	sv, err := NewSupervisor([]Service{{
+		Name: "flaky",
+		Cmd: []string{"sh", "-c", "test -f " + markerPath +
+			" && exit 0; touch " + markerPath + "; exit 1"},
+		Oneshot: true,
+		Restart: RestartOnFailure,
+	}})
+	if err != nil {
+		t.Fatalf("NewSupervisor failed: %v", err)
+	}
+
+	err = sv.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	st := sv.Status()
+	if len(st) != 1 || st[0].State != ServiceExited ||
+		st[0].Restarts != 1 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+}
+
+func TestRunServicesBlocks(t *testing.T) {
+	svcs := []Service{{Name: "server", Cmd: []string{"sleep", "1"},
+		Restart: RestartOnFailure}}
+
+	// without a -run command, only returns once the service exits
+	start := time.Now()
+	err := runServices(svcs, "", func(string) {
+		t.Errorf("unexpected run")
+	})
+	if err != nil || time.Since(start) < time.Duration(time.Second) {
+		t.Errorf("returned early after %v: %v", time.Since(start), err)
+	}
+
+	// the -run command is started once the service is ready, and is
+	// waited for even after the service exits
+	runCmds := make(chan string, 1)
+	release := make(chan struct{})
+	returned := make(chan error, 1)
+	go func() {
+		returned <- runServices(svcs, "echo hi", func(cmd string) {
+			runCmds <- cmd
+			<-release
+		})
+	}()
+	select {
+	case cmd := <-runCmds:
+		if cmd != "echo hi" {
+			t.Errorf("unexpected run command %q", cmd)
+		}
+	case <-time.After(time.Duration(5 * time.Second)):
+		t.Fatalf("run command not started")
+	}
+	select {
+	case err = <-returned:
+		t.Fatalf("returned with -run command pending: %v", err)
+	case <-time.After(time.Duration(2 * time.Second)):
+	}
+	close(release)
+	err = <-returned
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
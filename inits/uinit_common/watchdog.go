@@ -0,0 +1,46 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package uinit_common
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/kmodule"
+)
+
+// watchdog servicing daemon, included in the image if WATCHDOG is set. The
+// directory depends on the u-root builder used for the image.
+var watchdogdPaths = []string{"/bbin/watchdogd", "/bin/watchdogd"}
+
+// StartWatchdog starts watchdogd in the background if WATCHDOG="1" is set in
+// rapidos.conf. It runs in its own session, so outlives the uinit.
+func StartWatchdog(conf *RapidosConfMap) error {
+	if conf.f["WATCHDOG"] != "1" {
+		return nil
+	}
+	// may be builtin
+	kmodule.Probe("i6300esb", "")
+
+	watchdogdPath := watchdogdPaths[0]
+	for _, p := range watchdogdPaths {
+		if _, err := os.Stat(p); err == nil {
+			watchdogdPath = p
+			break
+		}
+	}
+	cmd := exec.Command(watchdogdPath)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start()
+}
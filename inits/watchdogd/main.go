@@ -0,0 +1,69 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+// watchdogd arms and services the QEMU i6300esb watchdog, which resets the VM
+// if the guest stops scheduling userspace, e.g. due to a kernel hang. It's
+// started via uinit_common.StartWatchdog() when WATCHDOG="1" is set.
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	watchdogDevPath = "/dev/watchdog"
+	// misc device major:minor, in case devtmpfs is unavailable
+	watchdogDevMajor = 10
+	watchdogDevMinor = 130
+
+	// _IOWR('W', 6, int)
+	wdiocSetTimeout = 0xc0045706
+
+	watchdogTimeout   = 30 // seconds
+	keepaliveInterval = time.Duration(5 * time.Second)
+)
+
+func main() {
+	_, err := os.Stat(watchdogDevPath)
+	if os.IsNotExist(err) {
+		err = syscall.Mknod(watchdogDevPath, syscall.S_IFCHR|0600,
+			watchdogDevMajor<<8|watchdogDevMinor)
+	}
+	if err != nil {
+		log.Fatalf("watchdog device unavailable: %v", err)
+	}
+
+	// the watchdog is armed on open
+	f, err := os.OpenFile(watchdogDevPath, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("failed to open watchdog: %v", err)
+	}
+
+	timeout := int32(watchdogTimeout)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		wdiocSetTimeout, uintptr(unsafe.Pointer(&timeout)))
+	if errno != 0 {
+		log.Printf("failed to set watchdog timeout: %v", errno)
+	}
+	log.Printf("watchdog armed with %ds timeout", timeout)
+
+	for {
+		_, err = f.Write([]byte{0})
+		if err != nil {
+			log.Printf("watchdog keepalive failed: %v", err)
+		}
+		time.Sleep(keepaliveInterval)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// BOOTP op codes
+const (
+	opRequest = 1
+	opReply   = 2
+)
+
+// DHCP message types (option 53)
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgDecline  = 4
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+	msgInform   = 8
+)
+
+// DHCP options used by the server
+const (
+	optPad         = 0
+	optSubnetMask  = 1
+	optRouter      = 3
+	optDNS         = 6
+	optHostname    = 12
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMsgType     = 53
+	optServerID    = 54
+	optRenewalTime = 58
+	optRebindTime  = 59
+	optEnd         = 255
+)
+
+const (
+	// BOOTP header length, preceding the magic cookie and options
+	fixedLen        = 236
+	magicCookieLen  = 4
+	minPacketLength = 300
+	broadcastFlag   = 0x8000
+	htypeEthernet   = 1
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// packet is a (BOOTP based) DHCPv4 message
+type packet struct {
+	op     byte
+	htype  byte
+	hlen   byte
+	xid    uint32
+	flags  uint16
+	ciaddr net.IP
+	yiaddr net.IP
+	siaddr net.IP
+	giaddr net.IP
+	chaddr net.HardwareAddr
+	// option code -> value. Pad and end options aren't included.
+	options map[byte][]byte
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < fixedLen+magicCookieLen {
+		return nil, fmt.Errorf("DHCP packet too short: %d", len(b))
+	}
+	p := &packet{
+		op:      b[0],
+		htype:   b[1],
+		hlen:    b[2],
+		xid:     binary.BigEndian.Uint32(b[4:8]),
+		flags:   binary.BigEndian.Uint16(b[10:12]),
+		ciaddr:  net.IP(append([]byte(nil), b[12:16]...)),
+		yiaddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		siaddr:  net.IP(append([]byte(nil), b[20:24]...)),
+		giaddr:  net.IP(append([]byte(nil), b[24:28]...)),
+		options: make(map[byte][]byte),
+	}
+	if p.hlen > 16 {
+		return nil, fmt.Errorf("invalid hardware address length: %d",
+			p.hlen)
+	}
+	p.chaddr = net.HardwareAddr(append([]byte(nil), b[28:28+p.hlen]...))
+
+	opts := b[fixedLen:]
+	for i := range magicCookie {
+		if opts[i] != magicCookie[i] {
+			return nil, fmt.Errorf("invalid DHCP magic cookie")
+		}
+	}
+	opts = opts[magicCookieLen:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated DHCP option %d", code)
+		}
+		l := int(opts[1])
+		// RFC 3396: concatenate repeated options
+		p.options[code] = append(p.options[code], opts[2:2+l]...)
+		opts = opts[2+l:]
+	}
+
+	return p, nil
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, fixedLen, minPacketLength)
+	b[0] = p.op
+	b[1] = p.htype
+	b[2] = p.hlen
+	binary.BigEndian.PutUint32(b[4:8], p.xid)
+	binary.BigEndian.PutUint16(b[10:12], p.flags)
+	copy(b[12:16], p.ciaddr.To4())
+	copy(b[16:20], p.yiaddr.To4())
+	copy(b[20:24], p.siaddr.To4())
+	copy(b[24:28], p.giaddr.To4())
+	copy(b[28:44], p.chaddr)
+	b = append(b, magicCookie...)
+
+	// message type first, for the benefit of picky clients
+	if t, ok := p.options[optMsgType]; ok {
+		b = append(b, optMsgType, byte(len(t)))
+		b = append(b, t...)
+	}
+	for code := 1; code < optEnd; code++ {
+		val, ok := p.options[byte(code)]
+		if !ok || code == optMsgType {
+			continue
+		}
+		for len(val) > 255 {
+			b = append(b, byte(code), 255)
+			b = append(b, val[:255]...)
+			val = val[255:]
+		}
+		b = append(b, byte(code), byte(len(val)))
+		b = append(b, val...)
+	}
+	b = append(b, optEnd)
+
+	// pad to minimum BOOTP length
+	for len(b) < minPacketLength {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func (p *packet) msgType() byte {
+	t := p.options[optMsgType]
+	if len(t) != 1 {
+		return 0
+	}
+	return t[0]
+}
+
+// return a IPv4 address option value, or nil if missing or invalid
+func (p *packet) ipOption(code byte) net.IP {
+	val := p.options[code]
+	if len(val) != net.IPv4len {
+		return nil
+	}
+	return net.IP(val)
+}
+
+func u32Option(val uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, val)
+	return b
+}
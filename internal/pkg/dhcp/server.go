@@ -0,0 +1,377 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+// Package dhcp provides a minimal DHCPv4 server, handing out static leases
+// for known MAC addresses alongside an optional dynamic address range. It is
+// intended for the rapidos bridge only, so relay agents aren't supported.
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StaticLease reserves @IP for the client with MAC address @MAC
+type StaticLease struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+}
+
+type Lease struct {
+	MAC      string
+	IP       string
+	Hostname string
+	Expiry   time.Time
+	Static   bool
+}
+
+type Config struct {
+	// server address, which is also provided to clients as the router
+	ServerIP net.IP
+	Mask     net.IPMask
+	Static   []StaticLease
+	// optional dynamic range, inclusive
+	RangeStart net.IP
+	RangeEnd   net.IP
+	LeaseTime  time.Duration
+	// optional IPv4 DNS servers
+	DNS []net.IP
+	// called with the current lease table whenever it changes
+	OnChange func([]Lease)
+}
+
+type lease struct {
+	ip       uint32
+	hostname string
+	expiry   time.Time
+	static   bool
+	// offered, but not yet requested
+	offered bool
+}
+
+type Server struct {
+	conf Config
+	// keyed by MAC address string
+	leases map[string]*lease
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+// how long an offered address is held while awaiting the client's request
+const offerTimeout = time.Duration(60 * time.Second)
+
+func ip2u32(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+func u322ip(val uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, val)
+	return ip
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if conf.ServerIP.To4() == nil {
+		return nil, fmt.Errorf("invalid DHCP server address: %v",
+			conf.ServerIP)
+	}
+	if conf.LeaseTime <= 0 {
+		return nil, fmt.Errorf("invalid DHCP lease time: %v",
+			conf.LeaseTime)
+	}
+	if conf.RangeStart != nil || conf.RangeEnd != nil {
+		start := ip2u32(conf.RangeStart)
+		end := ip2u32(conf.RangeEnd)
+		if start == 0 || end == 0 || start > end {
+			return nil, fmt.Errorf("invalid DHCP range: %v-%v",
+				conf.RangeStart, conf.RangeEnd)
+		}
+	}
+	for _, dns := range conf.DNS {
+		if dns.To4() == nil {
+			return nil, fmt.Errorf("invalid DHCP DNS server: %v",
+				dns)
+		}
+	}
+	for _, sl := range conf.Static {
+		if sl.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid DHCP address for %v: %v",
+				sl.MAC, sl.IP)
+		}
+	}
+
+	return &Server{
+		conf:   conf,
+		leases: make(map[string]*lease),
+		now:    time.Now,
+	}, nil
+}
+
+func (s *Server) lookupStatic(mac net.HardwareAddr) *StaticLease {
+	for i := range s.conf.Static {
+		if bytes.Equal(s.conf.Static[i].MAC, mac) {
+			return &s.conf.Static[i]
+		}
+	}
+	return nil
+}
+
+// check whether @ip is available for a dynamic lease to @mac
+func (s *Server) dynamicAvail(ip uint32, mac string) bool {
+	if s.conf.RangeStart == nil ||
+		ip < ip2u32(s.conf.RangeStart) || ip > ip2u32(s.conf.RangeEnd) {
+		return false
+	}
+	for _, sl := range s.conf.Static {
+		if ip2u32(sl.IP) == ip {
+			return false
+		}
+	}
+	now := s.now()
+	for m, l := range s.leases {
+		if m != mac && l.ip == ip && l.expiry.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// find an address for @mac, preferring its static or existing lease, then
+// @requested. Returns nil if none are available.
+func (s *Server) allocate(mac net.HardwareAddr, requested net.IP) *lease {
+	if sl := s.lookupStatic(mac); sl != nil {
+		return &lease{ip: ip2u32(sl.IP), hostname: sl.Hostname,
+			static: true}
+	}
+
+	if l, ok := s.leases[mac.String()]; ok &&
+		s.dynamicAvail(l.ip, mac.String()) {
+		return &lease{ip: l.ip, hostname: l.hostname}
+	}
+
+	if requested != nil && s.dynamicAvail(ip2u32(requested), mac.String()) {
+		return &lease{ip: ip2u32(requested)}
+	}
+
+	if s.conf.RangeStart == nil {
+		return nil
+	}
+	for ip := ip2u32(s.conf.RangeStart); ip <= ip2u32(s.conf.RangeEnd); ip++ {
+		if s.dynamicAvail(ip, mac.String()) {
+			return &lease{ip: ip}
+		}
+	}
+	return nil
+}
+
+func (s *Server) reply(req *packet, msgType byte, l *lease) *packet {
+	resp := &packet{
+		op:     opReply,
+		htype:  req.htype,
+		hlen:   req.hlen,
+		xid:    req.xid,
+		flags:  req.flags,
+		ciaddr: net.IPv4zero,
+		yiaddr: net.IPv4zero,
+		siaddr: net.IPv4zero,
+		giaddr: req.giaddr,
+		chaddr: req.chaddr,
+		options: map[byte][]byte{
+			optMsgType:  {msgType},
+			optServerID: []byte(s.conf.ServerIP.To4()),
+		},
+	}
+	if msgType == msgNak {
+		return resp
+	}
+
+	resp.yiaddr = u322ip(l.ip)
+	resp.siaddr = s.conf.ServerIP
+	secs := uint32(s.conf.LeaseTime / time.Second)
+	resp.options[optLeaseTime] = u32Option(secs)
+	resp.options[optRenewalTime] = u32Option(secs / 2)
+	resp.options[optRebindTime] = u32Option(secs / 8 * 7)
+	if s.conf.Mask != nil {
+		resp.options[optSubnetMask] = []byte(s.conf.Mask)
+	}
+	resp.options[optRouter] = []byte(s.conf.ServerIP.To4())
+	for _, dns := range s.conf.DNS {
+		resp.options[optDNS] = append(resp.options[optDNS],
+			dns.To4()...)
+	}
+	if l.hostname != "" {
+		resp.options[optHostname] = []byte(l.hostname)
+	}
+	return resp
+}
+
+// handle processes a single client message, returning the reply or nil if
+// none is needed. The lease table is returned if it changed.
+func (s *Server) handle(req *packet) (*packet, []Lease) {
+	if req.op != opRequest || req.htype != htypeEthernet ||
+		len(req.chaddr) != 6 {
+		return nil, nil
+	}
+	mac := req.chaddr.String()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch req.msgType() {
+	case msgDiscover:
+		l := s.allocate(req.chaddr, req.ipOption(optRequestedIP))
+		if l == nil {
+			log.Printf("DHCP: no address available for %s\n", mac)
+			return nil, nil
+		}
+		cur, ok := s.leases[mac]
+		if !l.static && (!ok || cur.ip != l.ip) {
+			l.offered = true
+			l.expiry = s.now().Add(offerTimeout)
+			s.leases[mac] = l
+		}
+		return s.reply(req, msgOffer, l), nil
+	case msgRequest:
+		serverID := req.ipOption(optServerID)
+		if serverID != nil && !serverID.Equal(s.conf.ServerIP) {
+			// client selected another server
+			if l, ok := s.leases[mac]; ok && l.offered {
+				delete(s.leases, mac)
+			}
+			return nil, nil
+		}
+		requested := req.ipOption(optRequestedIP)
+		if requested == nil && !req.ciaddr.Equal(net.IPv4zero) {
+			requested = req.ciaddr
+		}
+		l := s.allocate(req.chaddr, requested)
+		if l == nil || requested == nil || l.ip != ip2u32(requested) {
+			return s.reply(req, msgNak, nil), nil
+		}
+		if hostname := req.options[optHostname]; l.hostname == "" &&
+			len(hostname) > 0 {
+			l.hostname = string(hostname)
+		}
+		l.expiry = s.now().Add(s.conf.LeaseTime)
+		s.leases[mac] = l
+		return s.reply(req, msgAck, l), s.leaseTable()
+	case msgRelease, msgDecline:
+		if _, ok := s.leases[mac]; ok {
+			delete(s.leases, mac)
+			return nil, s.leaseTable()
+		}
+	}
+	return nil, nil
+}
+
+// caller must hold s.mutex
+func (s *Server) leaseTable() []Lease {
+	var table []Lease
+
+	now := s.now()
+	for mac, l := range s.leases {
+		if l.offered || !l.expiry.After(now) {
+			continue
+		}
+		table = append(table, Lease{
+			MAC:      mac,
+			IP:       u322ip(l.ip).String(),
+			Hostname: l.hostname,
+			Expiry:   l.expiry,
+			Static:   l.static,
+		})
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return ip2u32(net.ParseIP(table[i].IP)) <
+			ip2u32(net.ParseIP(table[j].IP))
+	})
+	return table
+}
+
+// Leases returns all active leases, sorted by IP address
+func (s *Server) Leases() []Lease {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leaseTable()
+}
+
+func (s *Server) respond(conn net.PacketConn, req *packet, resp *packet) error {
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	if !req.ciaddr.Equal(net.IPv4zero) &&
+		req.flags&broadcastFlag == 0 {
+		// renewing client can be reached directly
+		dst.IP = req.ciaddr
+	}
+	_, err := conn.WriteTo(resp.marshal(), dst)
+	return err
+}
+
+// Serve answers DHCP requests on @conn until it's closed
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req, err := parsePacket(buf[:n])
+		if err != nil {
+			log.Printf("DHCP: ignoring invalid packet: %v\n", err)
+			continue
+		}
+		resp, table := s.handle(req)
+		if resp != nil {
+			err = s.respond(conn, req, resp)
+			if err != nil {
+				log.Printf("DHCP: reply to %s failed: %v\n",
+					req.chaddr, err)
+			}
+		}
+		if table != nil && s.conf.OnChange != nil {
+			s.conf.OnChange(table)
+		}
+	}
+}
+
+// Listen opens a DHCP server socket, bound to network interface @ifName
+func Listen(ifName string) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.BindToDevice(int(fd), ifName)
+				if serr != nil {
+					return
+				}
+				serr = syscall.SetsockoptInt(int(fd),
+					syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp4", ":67")
+}
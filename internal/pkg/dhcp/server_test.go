@@ -0,0 +1,162 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *Server {
+	mac, _ := net.ParseMAC("b8:ac:24:45:c5:01")
+	s, err := NewServer(Config{
+		ServerIP: net.ParseIP("192.168.155.1"),
+		Mask:     net.CIDRMask(24, 32),
+		Static: []StaticLease{{
+			MAC:      mac,
+			IP:       net.ParseIP("192.168.155.101"),
+			Hostname: "rapido1",
+		}},
+		RangeStart: net.ParseIP("192.168.155.10"),
+		RangeEnd:   net.ParseIP("192.168.155.11"),
+		LeaseTime:  time.Duration(12 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return s
+}
+
+// build a client message, round-tripped through the wire format
+func clientMsg(t *testing.T, msgType byte, mac string,
+	opts map[byte][]byte) *packet {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packet{
+		op:      opRequest,
+		htype:   htypeEthernet,
+		hlen:    6,
+		xid:     0x1234,
+		ciaddr:  net.IPv4zero,
+		yiaddr:  net.IPv4zero,
+		siaddr:  net.IPv4zero,
+		giaddr:  net.IPv4zero,
+		chaddr:  hwaddr,
+		options: map[byte][]byte{optMsgType: {msgType}},
+	}
+	for code, val := range opts {
+		p.options[code] = val
+	}
+	parsed, err := parsePacket(p.marshal())
+	if err != nil {
+		t.Fatalf("failed to parse marshalled packet: %v", err)
+	}
+	return parsed
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := clientMsg(t, msgDiscover, "b8:ac:24:45:c5:01",
+		map[byte][]byte{optHostname: []byte("vm")})
+	if p.xid != 0x1234 || p.chaddr.String() != "b8:ac:24:45:c5:01" {
+		t.Fatalf("unexpected header: %+v", p)
+	}
+	if p.msgType() != msgDiscover ||
+		string(p.options[optHostname]) != "vm" {
+		t.Fatalf("unexpected options: %v", p.options)
+	}
+
+	_, err := parsePacket(make([]byte, fixedLen))
+	if err == nil {
+		t.Fatalf("short packet parsed successfully")
+	}
+}
+
+func TestStaticLease(t *testing.T) {
+	s := newTestServer(t)
+
+	offer, _ := s.handle(clientMsg(t, msgDiscover, "b8:ac:24:45:c5:01",
+		nil))
+	if offer == nil || offer.msgType() != msgOffer {
+		t.Fatalf("expected offer, got %+v", offer)
+	}
+	if offer.yiaddr.String() != "192.168.155.101" ||
+		string(offer.options[optHostname]) != "rapido1" {
+		t.Fatalf("unexpected static offer: %v %v", offer.yiaddr,
+			offer.options)
+	}
+
+	ack, table := s.handle(clientMsg(t, msgRequest, "b8:ac:24:45:c5:01",
+		map[byte][]byte{
+			optRequestedIP: offer.yiaddr,
+			optServerID:    offer.options[optServerID],
+		}))
+	if ack == nil || ack.msgType() != msgAck {
+		t.Fatalf("expected ack, got %+v", ack)
+	}
+	if len(table) != 1 || !table[0].Static ||
+		table[0].IP != "192.168.155.101" {
+		t.Fatalf("unexpected lease table: %+v", table)
+	}
+
+	// static lease holder can't request a different address
+	nak, _ := s.handle(clientMsg(t, msgRequest, "b8:ac:24:45:c5:01",
+		map[byte][]byte{optRequestedIP: net.ParseIP("192.168.155.10").To4()}))
+	if nak == nil || nak.msgType() != msgNak {
+		t.Fatalf("expected nak, got %+v", nak)
+	}
+}
+
+func TestDynamicLease(t *testing.T) {
+	s := newTestServer(t)
+
+	var ips []string
+	for _, mac := range []string{"b8:ac:24:45:c5:10", "b8:ac:24:45:c5:11"} {
+		offer, _ := s.handle(clientMsg(t, msgDiscover, mac, nil))
+		if offer == nil {
+			t.Fatalf("no offer for %s", mac)
+		}
+		ack, _ := s.handle(clientMsg(t, msgRequest, mac,
+			map[byte][]byte{optRequestedIP: offer.yiaddr}))
+		if ack == nil || ack.msgType() != msgAck {
+			t.Fatalf("expected ack for %s, got %+v", mac, ack)
+		}
+		ips = append(ips, ack.yiaddr.String())
+	}
+	if ips[0] != "192.168.155.10" || ips[1] != "192.168.155.11" {
+		t.Fatalf("unexpected dynamic addresses: %v", ips)
+	}
+
+	// range exhausted
+	offer, _ := s.handle(clientMsg(t, msgDiscover, "b8:ac:24:45:c5:12", nil))
+	if offer != nil {
+		t.Fatalf("unexpected offer from exhausted range: %v",
+			offer.yiaddr)
+	}
+
+	_, table := s.handle(clientMsg(t, msgRelease, "b8:ac:24:45:c5:10", nil))
+	if len(table) != 1 || table[0].MAC != "b8:ac:24:45:c5:11" {
+		t.Fatalf("unexpected lease table after release: %+v", table)
+	}
+
+	// released address can be reused, as can expired leases
+	s.now = func() time.Time { return time.Now().Add(13 * time.Hour) }
+	offer, _ = s.handle(clientMsg(t, msgDiscover, "b8:ac:24:45:c5:12", nil))
+	if offer == nil || offer.yiaddr.String() != "192.168.155.10" {
+		t.Fatalf("expected reuse of released address, got %+v", offer)
+	}
+	if len(s.Leases()) != 0 {
+		t.Fatalf("expired leases listed: %+v", s.Leases())
+	}
+}
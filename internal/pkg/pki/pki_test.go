@@ -0,0 +1,71 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("test CA", time.Duration(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCA failed: %v", err)
+	}
+	certPEM, keyPEM, err := ca.Issue("vm1",
+		[]net.IP{net.ParseIP("192.168.155.101"),
+			net.ParseIP("fd00::101")}, time.Duration(time.Hour))
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	// certificate and key must pair up
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("invalid key pair: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca.CertPEM) {
+		t.Fatalf("failed to parse CA certificate")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("failed to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	for _, name := range []string{"vm1", "192.168.155.101", "fd00::101"} {
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   roots,
+			KeyUsages: []x509.ExtKeyUsage{
+				x509.ExtKeyUsageServerAuth,
+				x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			t.Errorf("verification for %s failed: %v", name, err)
+		}
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "vm2", Roots: roots})
+	if err == nil {
+		t.Errorf("verification for unlisted name succeeded")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+// Package qmp provides a minimal client for the QEMU Machine Protocol, as
+// exposed by rapidos VMs via a unix socket alongside the QEMU pidfile.
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+type Client struct {
+	conn    net.Conn
+	dec     *json.Decoder
+	timeout time.Duration
+	// asynchronous events received while waiting for command responses
+	Events []Event
+}
+
+type Event struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Error is returned when QEMU responds to a command with an error
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP %s: %s", e.Class, e.Desc)
+}
+
+type response struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event
+}
+
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// Dial connects to the QMP unix socket at @sockPath and negotiates
+// capabilities. @timeout applies to each subsequent command.
+func Dial(sockPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", sockPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		dec:     json.NewDecoder(conn),
+		timeout: timeout,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	var greeting map[string]json.RawMessage
+	err = c.dec.Decode(&greeting)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+
+	_, err = c.Execute("qmp_capabilities", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Execute runs QMP command @cmd with optional @args, returning the raw JSON
+// "return" value.
+func (c *Client) Execute(cmd string, args interface{}) (json.RawMessage,
+	error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	b, err := json.Marshal(command{Execute: cmd, Arguments: args})
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn.Write(append(b, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var resp response
+		err = c.dec.Decode(&resp)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Event.Event != "" {
+			c.Events = append(c.Events, resp.Event)
+			continue // asynchronous event, not our response
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Return, nil
+	}
+}
+
+type Status struct {
+	Status  string `json:"status"`
+	Running bool   `json:"running"`
+}
+
+func (c *Client) QueryStatus() (*Status, error) {
+	ret, err := c.Execute("query-status", nil)
+	if err != nil {
+		return nil, err
+	}
+	var st Status
+	err = json.Unmarshal(ret, &st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// SystemPowerdown requests a graceful (ACPI) guest shutdown
+func (c *Client) SystemPowerdown() error {
+	_, err := c.Execute("system_powerdown", nil)
+	return err
+}
+
+// DeviceAdd hotplugs a @driver device with @id and additional @props, e.g.
+// DeviceAdd("virtio-blk-pci", "disk9", map[string]string{"drive": "drv9"})
+func (c *Client) DeviceAdd(driver string, id string,
+	props map[string]string) error {
+	args := map[string]string{"driver": driver, "id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	_, err := c.Execute("device_add", args)
+	return err
+}
+
+func (c *Client) DeviceDel(id string) error {
+	_, err := c.Execute("device_del", map[string]string{"id": id})
+	return err
+}
+
+// BlockInfo describes a VM block device, as returned by query-block
+type BlockInfo struct {
+	Device string `json:"device"`
+	// nil if no medium is inserted
+	Inserted *struct {
+		Drv string `json:"drv"`
+		RO  bool   `json:"ro"`
+	} `json:"inserted"`
+}
+
+func (c *Client) QueryBlock() ([]BlockInfo, error) {
+	ret, err := c.Execute("query-block", nil)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []BlockInfo
+	err = json.Unmarshal(ret, &blocks)
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// SaveVM snapshots the VM state under @tag. QEMU only provides savevm via the
+// human monitor, so it's wrapped here. The VM state is stored on a writable
+// qcow2 drive, which rapidos doesn't attach by default, so one must be
+// hotplugged first.
+func (c *Client) SaveVM(tag string) error {
+	blocks, err := c.QueryBlock()
+	if err != nil {
+		return err
+	}
+	snapshotable := false
+	for _, b := range blocks {
+		snapshotable = snapshotable || (b.Inserted != nil &&
+			b.Inserted.Drv == "qcow2" && !b.Inserted.RO)
+	}
+	if !snapshotable {
+		return fmt.Errorf("savevm requires a writable qcow2 drive, " +
+			"but none is attached")
+	}
+
+	ret, err := c.Execute("human-monitor-command",
+		map[string]string{"command-line": "savevm " + tag})
+	if err != nil {
+		return err
+	}
+	// HMP errors are returned as output text
+	var out string
+	err = json.Unmarshal(ret, &out)
+	if err == nil && out != "" {
+		return fmt.Errorf("savevm failed: %s", out)
+	}
+	return nil
+}
+
+// ReadEvent returns the next asynchronous event, blocking until one arrives or
+// the connection is closed, e.g. due to QEMU exit.
+func (c *Client) ReadEvent() (*Event, error) {
+	if len(c.Events) > 0 {
+		ev := c.Events[0]
+		c.Events = c.Events[1:]
+		return &ev, nil
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	for {
+		var resp response
+		err := c.dec.Decode(&resp)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Event.Event != "" {
+			return &resp.Event, nil
+		}
+		// stray command responses are ignored
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package qmp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeQMP serves a single QMP connection on a unix socket, answering
+// commands via @replies, keyed by command name.
+type fakeQMP struct {
+	sockPath string
+	ln       net.Listener
+	// commands received, in order
+	cmds chan command
+}
+
+func newFakeQMP(t *testing.T, dir string,
+	replies map[string]string) *fakeQMP {
+	f := &fakeQMP{
+		sockPath: path.Join(dir, "vm.qmp"),
+		cmds:     make(chan command, 16),
+	}
+	ln, err := net.Listen("unix", f.sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ln = ln
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` +
+			"\n"))
+		dec := json.NewDecoder(conn)
+		for {
+			var cmd command
+			if dec.Decode(&cmd) != nil {
+				return
+			}
+			f.cmds <- cmd
+			reply, ok := replies[cmd.Execute]
+			if !ok {
+				reply = `{"return": {}}`
+			}
+			conn.Write([]byte(reply + "\n"))
+		}
+	}()
+
+	return f
+}
+
+func TestClient(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-qmp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	f := newFakeQMP(t, tmpDir, map[string]string{
+		// event interleaved ahead of the command response
+		"query-status": `{"event": "RESUME", "data": {}}` + "\n" +
+			`{"return": {"status": "running", "running": true}}`,
+		"device_del": `{"error": {"class": "DeviceNotFound", ` +
+			`"desc": "Device 'nope' not found"}}`,
+		"human-monitor-command": `{"return": ""}`,
+		"query-block": `{"return": [` +
+			`{"device": "cd0", "inserted": null}, ` +
+			`{"device": "drv9", "inserted": ` +
+			`{"drv": "qcow2", "ro": false}}]}`,
+		// event following the command response
+		"stop": `{"return": {}}` + "\n" +
+			`{"event": "STOP", "data": {}}`,
+	})
+	defer f.ln.Close()
+
+	c, err := Dial(f.sockPath, time.Duration(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if cmd := <-f.cmds; cmd.Execute != "qmp_capabilities" {
+		t.Errorf("expected capabilities negotiation, got %s",
+			cmd.Execute)
+	}
+
+	st, err := c.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if st.Status != "running" || !st.Running {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if len(c.Events) != 1 || c.Events[0].Event != "RESUME" {
+		t.Errorf("unexpected events: %+v", c.Events)
+	}
+	<-f.cmds
+
+	err = c.SystemPowerdown()
+	if err != nil {
+		t.Errorf("SystemPowerdown failed: %v", err)
+	}
+	if cmd := <-f.cmds; cmd.Execute != "system_powerdown" {
+		t.Errorf("unexpected command %s", cmd.Execute)
+	}
+
+	err = c.DeviceAdd("virtio-blk-pci", "disk9",
+		map[string]string{"drive": "drv9"})
+	if err != nil {
+		t.Errorf("DeviceAdd failed: %v", err)
+	}
+	cmd := <-f.cmds
+	args, _ := cmd.Arguments.(map[string]interface{})
+	if cmd.Execute != "device_add" || args["driver"] != "virtio-blk-pci" ||
+		args["id"] != "disk9" || args["drive"] != "drv9" {
+		t.Errorf("unexpected device_add: %+v", cmd)
+	}
+
+	err = c.DeviceDel("nope")
+	qmpErr, ok := err.(*Error)
+	if !ok || qmpErr.Class != "DeviceNotFound" {
+		t.Errorf("unexpected DeviceDel error: %v", err)
+	}
+	<-f.cmds
+
+	err = c.SaveVM("snap1")
+	if err != nil {
+		t.Errorf("SaveVM failed: %v", err)
+	}
+	if cmd = <-f.cmds; cmd.Execute != "query-block" {
+		t.Errorf("unexpected command %s", cmd.Execute)
+	}
+	cmd = <-f.cmds
+	args, _ = cmd.Arguments.(map[string]interface{})
+	if args["command-line"] != "savevm snap1" {
+		t.Errorf("unexpected savevm: %+v", cmd)
+	}
+
+	// queued RESUME from query-status is returned first
+	_, err = c.Execute("stop", nil)
+	if err != nil {
+		t.Errorf("stop failed: %v", err)
+	}
+	<-f.cmds
+	for _, want := range []string{"RESUME", "STOP"} {
+		ev, err := c.ReadEvent()
+		if err != nil || ev.Event != want {
+			t.Errorf("expected %s event, got %+v: %v", want, ev, err)
+		}
+	}
+}
+
+func TestSaveVMNoSnapshotDrive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-qmp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// raw zram-style disk only, which can't hold snapshots
+	f := newFakeQMP(t, tmpDir, map[string]string{
+		"query-block": `{"return": [{"device": "drv0", "inserted": ` +
+			`{"drv": "raw", "ro": false}}]}`,
+	})
+	defer f.ln.Close()
+
+	c, err := Dial(f.sockPath, time.Duration(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	<-f.cmds
+
+	err = c.SaveVM("snap1")
+	if err == nil || !strings.Contains(err.Error(), "qcow2") {
+		t.Errorf("unexpected SaveVM error: %v", err)
+	}
+	<-f.cmds
+	select {
+	case cmd := <-f.cmds:
+		t.Errorf("unexpected command %s", cmd.Execute)
+	default:
+	}
+}
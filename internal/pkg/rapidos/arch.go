@@ -0,0 +1,200 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+type archDef struct {
+	// kernel image path, relative to KERNEL_SRC
+	kernImg string
+	// qemu-system-<arch> binary name
+	qemuBin string
+	// QEMU -machine type. Empty for the QEMU default.
+	machine string
+	// QEMU -cpu model to use with KVM or TCG. Empty for the QEMU default.
+	kvmCPU string
+	tcgCPU string
+	// kernel console device for the first serial port
+	console string
+	// optional QEMU -device, used by uinits to power off with a failure
+	// exit status
+	exitDev string
+	// GOARCH for initramfs binaries
+	goarch string
+}
+
+// supported ARCH values, named after the kernel's uname -m
+var archs = map[string]archDef{
+	"x86_64": {
+		kernImg: "arch/x86/boot/bzImage",
+		qemuBin: "qemu-system-x86_64",
+		console: "ttyS0",
+		exitDev: "isa-debug-exit,iobase=0xf4,iosize=0x04",
+		goarch:  "amd64",
+	},
+	"arm64": {
+		kernImg: "arch/arm64/boot/Image",
+		qemuBin: "qemu-system-aarch64",
+		machine: "virt",
+		kvmCPU:  "host",
+		tcgCPU:  "max",
+		console: "ttyAMA0",
+		goarch:  "arm64",
+	},
+	"ppc64le": {
+		// QEMU's pseries machine boots the ELF vmlinux directly
+		kernImg: "vmlinux",
+		qemuBin: "qemu-system-ppc64",
+		machine: "pseries",
+		console: "hvc0",
+		goarch:  "ppc64le",
+	},
+}
+
+// determine the ARCH for the host, used for the running kernel
+func hostArch() (string, error) {
+	for name, a := range archs {
+		if a.goarch == runtime.GOARCH {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported host architecture %s",
+		runtime.GOARCH)
+}
+
+// determine the ARCH based on the kernel source .config
+func kernelConfigArch(kernelSrc string) (string, error) {
+	file, err := os.Open(path.Join(kernelSrc, ".config"))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	syms := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, "=y") {
+			syms[strings.TrimSuffix(line, "=y")] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case syms["CONFIG_X86_64"]:
+		return "x86_64", nil
+	case syms["CONFIG_ARM64"]:
+		return "arm64", nil
+	case syms["CONFIG_PPC64"] && syms["CONFIG_CPU_LITTLE_ENDIAN"]:
+		return "ppc64le", nil
+	}
+	return "", fmt.Errorf("unknown architecture in %s/.config", kernelSrc)
+}
+
+// GetArch returns the configured ARCH, or if unset, the architecture of the
+// KERNEL_SRC build (or the host if using the running kernel).
+func (conf *RapidosConf) GetArch() (string, error) {
+	arch := conf.f["ARCH"]
+	if arch != "" {
+		if _, ok := archs[arch]; !ok {
+			return "", fmt.Errorf("unsupported ARCH %s", arch)
+		}
+		return arch, nil
+	}
+
+	if conf.f["KERNEL_SRC"] == "" {
+		return hostArch()
+	}
+
+	kernelSrc, err := checkDirVal(conf.f, "KERNEL_SRC")
+	if err != nil {
+		return "", err
+	}
+	arch, err = kernelConfigArch(kernelSrc)
+	if err != nil {
+		return "", err
+	}
+	if conf.Debug {
+		log.Printf("ARCH %s detected via kernel config\n", arch)
+	}
+	return arch, nil
+}
+
+func (conf *RapidosConf) getArchDef() (*archDef, error) {
+	arch, err := conf.GetArch()
+	if err != nil {
+		return nil, err
+	}
+	a := archs[arch]
+	return &a, nil
+}
+
+// KVM can only be used for guests matching the host architecture
+func (a *archDef) kvmUsable() bool {
+	if a.goarch != runtime.GOARCH {
+		return false
+	}
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// return QEMU binary names, in order of preference
+func (a *archDef) qemuBins() []string {
+	if a.goarch == runtime.GOARCH {
+		// distro specific KVM wrappers
+		return []string{"qemu-kvm", "kvm", a.qemuBin}
+	}
+	return []string{a.qemuBin}
+}
+
+// return -machine and -cpu QEMU arguments, using KVM acceleration if
+// available, otherwise falling back to TCG emulation. A non-empty @cpuModel
+// overrides the architecture default -cpu model.
+func (a *archDef) qemuMachineArgs(cpuModel string) []string {
+	accel := "accel=tcg"
+	cpu := a.tcgCPU
+	if a.kvmUsable() {
+		accel = "accel=kvm"
+		cpu = a.kvmCPU
+	} else {
+		log.Printf("KVM unavailable for %s guest, using TCG\n",
+			a.qemuBin)
+	}
+
+	if cpuModel != "" {
+		cpu = cpuModel
+	}
+
+	machine := accel
+	if a.machine != "" {
+		machine = a.machine + "," + accel
+	}
+	args := []string{"-machine", machine}
+	if cpu != "" {
+		args = append(args, "-cpu", cpu)
+	}
+	return args
+}
@@ -0,0 +1,152 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestKernelConfigArch(t *testing.T) {
+	kernelSrc, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kernelSrc)
+
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "x86_64",
+			config: "CONFIG_64BIT=y\nCONFIG_X86_64=y\n",
+			want:   "x86_64",
+		},
+		{
+			name:   "arm64",
+			config: "CONFIG_ARM64=y\n# CONFIG_X86_64 is not set\n",
+			want:   "arm64",
+		},
+		{
+			name:   "ppc64le",
+			config: "CONFIG_PPC64=y\nCONFIG_CPU_LITTLE_ENDIAN=y\n",
+			want:   "ppc64le",
+		},
+		{
+			// module symbols don't select an arch
+			name:    "x86_64 as module",
+			config:  "CONFIG_X86_64=m\n",
+			wantErr: "unknown architecture",
+		},
+		{
+			name:    "big endian ppc64",
+			config:  "CONFIG_PPC64=y\nCONFIG_CPU_BIG_ENDIAN=y\n",
+			wantErr: "unknown architecture",
+		},
+		{
+			name:    "empty",
+			wantErr: "unknown architecture",
+		},
+	}
+
+	for _, tc := range tests {
+		err = ioutil.WriteFile(path.Join(kernelSrc, ".config"),
+			[]byte(tc.config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arch, err := kernelConfigArch(kernelSrc)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(),
+				tc.wantErr) {
+				t.Errorf("%s: got %q, %v, want error %q", tc.name,
+					arch, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || arch != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, arch, err,
+				tc.want)
+		}
+	}
+
+	_, err = kernelConfigArch(path.Join(kernelSrc, "missing"))
+	if err == nil {
+		t.Errorf("expected error for missing .config")
+	}
+}
+
+func TestGetArch(t *testing.T) {
+	kernelSrc, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kernelSrc)
+	err = ioutil.WriteFile(path.Join(kernelSrc, ".config"),
+		[]byte("CONFIG_ARM64=y\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		conf    map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "explicit ARCH overrides kernel config",
+			conf: map[string]string{"ARCH": "ppc64le",
+				"KERNEL_SRC": kernelSrc},
+			want: "ppc64le",
+		},
+		{
+			name: "detected via kernel config",
+			conf: map[string]string{"KERNEL_SRC": kernelSrc},
+			want: "arm64",
+		},
+		{
+			name:    "unsupported ARCH",
+			conf:    map[string]string{"ARCH": "riscv64"},
+			wantErr: "unsupported ARCH riscv64",
+		},
+		{
+			name: "KERNEL_SRC without .config",
+			conf: map[string]string{
+				"KERNEL_SRC": path.Join(kernelSrc, "missing")},
+			wantErr: "missing",
+		},
+	}
+
+	for _, tc := range tests {
+		conf := &RapidosConf{f: tc.conf}
+		arch, err := conf.GetArch()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(),
+				tc.wantErr) {
+				t.Errorf("%s: got %q, %v, want error %q", tc.name,
+					arch, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || arch != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, arch, err,
+				tc.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// per-VM console output is logged alongside the pidfile
+func getConsolePath(vmPidPath string) string {
+	return getVMStatePath(vmPidPath, ".log")
+}
+
+// start VM @vmIndex in the background, with console output logged to file
+func startQEMU(conf *RapidosConf, imgPath string, resc Resources,
+	vmPidPath string, vmIndex int) error {
+	cmd, err := getQEMUCmd(conf, imgPath, resc, vmPidPath, vmIndex,
+		getConsolePath(vmPidPath))
+	if err != nil {
+		return err
+	}
+
+	err = writeVMInfo(conf, imgPath, resc, vmPidPath, vmIndex)
+	if err != nil {
+		return err
+	}
+	err = removeResults(vmPidPath)
+	if err != nil {
+		return err
+	}
+
+	// QEMU only returns once daemonized, or on startup failure
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("VM %d failed to start: %v: %s", vmIndex, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// return the addresses of manifest declared ports for VM @vmIndex, which can
+// be checked to determine whether the VM is up
+func getVMPortAddrs(conf *RapidosConf, resc Resources,
+	vmPidPath string, vmIndex int) ([]string, error) {
+	var addrs []string
+
+	if !resc.Network {
+		return nil, nil
+	}
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return nil, err
+	}
+
+	if netMode == netModeUser {
+		for _, guestPort := range resc.Ports {
+			hostPort, err := getUserNetHostPort(conf, guestPort,
+				vmIndex)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, net.JoinHostPort("127.0.0.1",
+				strconv.Itoa(hostPort)))
+		}
+		return addrs, nil
+	}
+
+	info, err := readVMInfo(vmPidPath, vmIndex)
+	if err != nil {
+		return nil, err
+	}
+	ipAddr := info.IPAddr
+	if ipAddr == "" {
+		ipAddr = info.IP6Addr
+	}
+	if ipAddr == "" {
+		return nil, nil // DHCP, so address unknown
+	}
+	for _, guestPort := range resc.Ports {
+		addrs = append(addrs, net.JoinHostPort(ipAddr,
+			strconv.Itoa(int(guestPort))))
+	}
+	return addrs, nil
+}
+
+// wait for VM @vmIndex to come up, as indicated by a uinit ready result or its
+// manifest declared ports accepting connections. VMs without any known ports
+// are considered up once QEMU reports them as running.
+func waitVMUp(conf *RapidosConf, resc Resources, pidsDir string, vmIndex int,
+	deadline time.Time) error {
+	vmPidPath := getPidPath(pidsDir, vmIndex)
+	addrs, err := getVMPortAddrs(conf, resc, vmPidPath, vmIndex)
+	if err != nil {
+		return err
+	}
+
+	for time.Now().Before(deadline) {
+		isRunning, err := checkQEMUProc(vmPidPath)
+		if err != nil {
+			return err
+		}
+		if !isRunning {
+			return fmt.Errorf("VM %d exited, see %s", vmIndex,
+				getConsolePath(vmPidPath))
+		}
+		results, err := ReadVMResults(pidsDir, vmIndex)
+		if err != nil {
+			return err
+		}
+		err = resultsFailure(vmIndex, results)
+		if err != nil {
+			return err
+		}
+		if resultsReady(results) {
+			return nil
+		}
+
+		up := true
+		if len(addrs) == 0 {
+			c, err := DialQMP(pidsDir, vmIndex,
+				time.Duration(time.Second))
+			up = false
+			if err == nil {
+				st, err := c.QueryStatus()
+				up = err == nil && st.Running
+				c.Close()
+			}
+		}
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout("tcp", addr,
+				time.Duration(time.Second))
+			if err != nil {
+				up = false
+				break
+			}
+			conn.Close()
+		}
+		if up {
+			return nil
+		}
+		time.Sleep(time.Duration(500 * time.Millisecond))
+	}
+
+	return fmt.Errorf("VM %d didn't come up in time, see %s", vmIndex,
+		getConsolePath(vmPidPath))
+}
+
+// stop all VMs in @vmIndices concurrently
+func stopCluster(pidsDir string, vmIndices []int) {
+	var wg sync.WaitGroup
+
+	for _, vmIndex := range vmIndices {
+		wg.Add(1)
+		go func(vmIndex int) {
+			defer wg.Done()
+			err := StopVM(pidsDir, vmIndex, DefaultStopTimeout)
+			if err != nil {
+				log.Printf("failed to stop VM %d: %v\n", vmIndex,
+					err)
+				return
+			}
+			fmt.Printf("stopped VM %d\n", vmIndex)
+		}(vmIndex)
+	}
+	wg.Wait()
+}
+
+// kernel parameter listing cluster VM indices, which must match uinit_common
+const clusterParam = "rapidos.cluster"
+
+// return the kernel parameter which tells each VM in @vmIndices that it's part
+// of a cluster alongside the others
+func getClusterKernArg(vmIndices []int) string {
+	var s []string
+	for _, vmIndex := range vmIndices {
+		s = append(s, strconv.Itoa(vmIndex))
+	}
+	return clusterParam + "=" + strings.Join(s, ",")
+}
+
+// DefaultClusterTimeout is how long BootCluster() waits for all VMs to come
+// up, if BOOT_TIMEOUT isn't set.
+const DefaultClusterTimeout = time.Duration(2 * time.Minute)
+
+// BootCluster boots @nVMs daemonized VMs from @imgPath, using the first free
+// VM indices. Console output for each VM is logged to a file alongside its
+// pidfile. Once all VMs are up, BootCluster blocks until SIGINT or SIGTERM,
+// and then shuts all VMs down. VMs are also shut down if any fail to come up
+// within BOOT_TIMEOUT, or DefaultClusterTimeout if unset.
+func BootCluster(conf *RapidosConf, imgPath string, pidsDir string,
+	nVMs int) error {
+	var resc Resources
+	var vmIndices []int
+
+	if nVMs < 1 {
+		return fmt.Errorf("invalid cluster size %d", nVMs)
+	}
+
+	timeout, err := conf.GetBootTimeout()
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		timeout = DefaultClusterTimeout
+	}
+
+	err = resc.Retrieve(imgPath)
+	if err != nil {
+		return err
+	}
+
+	maxVMs, err := getMaxVMs(conf, resc)
+	if err != nil {
+		return err
+	}
+	for vmIndex := 1; vmIndex <= maxVMs && len(vmIndices) < nVMs; vmIndex++ {
+		isRunning, err := checkQEMUProc(getPidPath(pidsDir, vmIndex))
+		if err != nil {
+			return err
+		}
+		if !isRunning {
+			vmIndices = append(vmIndices, vmIndex)
+		}
+	}
+	if len(vmIndices) < nVMs {
+		return fmt.Errorf("only %d of %d requested VMs available",
+			len(vmIndices), nVMs)
+	}
+
+	// copy, to avoid modifying the retrieved slice
+	resc.KernelArgs = append(append([]string{}, resc.KernelArgs...),
+		getClusterKernArg(vmIndices))
+
+	// register early, so that Ctrl-C during startup also tears down
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var started []int
+	for _, vmIndex := range vmIndices {
+		err = startQEMU(conf, imgPath, resc,
+			getPidPath(pidsDir, vmIndex), vmIndex)
+		if err != nil {
+			stopCluster(pidsDir, started)
+			return err
+		}
+		started = append(started, vmIndex)
+		fmt.Printf("started VM %d, console: %s\n", vmIndex,
+			getConsolePath(getPidPath(pidsDir, vmIndex)))
+	}
+
+	upErr := make(chan error, 1)
+	go func() {
+		deadline := time.Now().Add(timeout)
+		for _, vmIndex := range started {
+			err := waitVMUp(conf, resc, pidsDir, vmIndex, deadline)
+			if err != nil {
+				upErr <- err
+				return
+			}
+		}
+		upErr <- nil
+	}()
+
+	select {
+	case err = <-upErr:
+		if err != nil {
+			stopCluster(pidsDir, started)
+			return err
+		}
+	case <-sigs:
+		stopCluster(pidsDir, started)
+		return fmt.Errorf("interrupted while waiting for VMs")
+	}
+
+	fmt.Printf("all %d VMs up, Ctrl-C to shut down\n", len(started))
+	<-sigs
+	stopCluster(pidsDir, started)
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVMPortAddrs(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	resc := Resources{Network: true, Ports: []uint16{2379}}
+	vmPidPath := getPidPath(pidsDir, 2)
+
+	conf := &RapidosConf{f: map[string]string{"NET_MODE": "user",
+		"NET_USER_PORT_OFFSET": "10000"}}
+	addrs, err := getVMPortAddrs(conf, resc, vmPidPath, 2)
+	if err != nil {
+		t.Fatalf("getVMPortAddrs failed: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1:12479"}) {
+		t.Errorf("unexpected user-mode addresses: %v", addrs)
+	}
+
+	conf = &RapidosConf{f: map[string]string{}}
+	err = ioutil.WriteFile(getVMInfoPath(vmPidPath),
+		[]byte(`{"Index": 2, "IP6Addr": "fd00::2"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = getVMPortAddrs(conf, resc, vmPidPath, 2)
+	if err != nil {
+		t.Fatalf("getVMPortAddrs failed: %v", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"[fd00::2]:2379"}) {
+		t.Errorf("unexpected bridge addresses: %v", addrs)
+	}
+}
+
+func TestClusterKernArg(t *testing.T) {
+	arg := getClusterKernArg([]int{2, 3, 5})
+	if arg != "rapidos.cluster=2,3,5" {
+		t.Errorf("unexpected cluster kernel parameter: %s", arg)
+	}
+}
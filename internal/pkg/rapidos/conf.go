@@ -17,10 +17,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/user"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	// embedded vendor repo
 	"github.com/go-ini/ini"
@@ -29,30 +33,39 @@ import (
 type RapidosConf struct {
 	// rapidos.conf key=val map
 	f map[string]string
+	// per-VM key=val maps from [vm.<index>] sections, keyed by vmIndex
+	vms map[int]map[string]string
 
 	// command line
 	Debug bool
+	// directory holding the image being cut. Set by Cut() so that
+	// InventoryCB can leave generated files (e.g. CA certificates) there.
+	ImgDir string
 }
 
-// basic support for conf variable expansion
-func parseConfExpand(f map[string]string) error {
-	for key, val := range f {
-		// fast path if no variable to expand
-		if !strings.Contains(val, "$") {
+// collect per-VM [vm.<index>] sections, e.g.
+// [vm.1]
+// tap = "tap0"
+// mac = "b8:ac:24:45:c5:01"
+func parseConfVMSections(cfg *ini.File) (map[int]map[string]string, error) {
+	vms := make(map[int]map[string]string)
+
+	for _, sect := range cfg.Sections() {
+		name := sect.Name()
+		if name == ini.DEFAULT_SECTION {
 			continue
 		}
-		for rkey, rval := range f {
-			val = strings.Replace(val, "${"+rkey+"}", rval, -1)
-			val = strings.Replace(val, "$"+rkey, rval, -1)
+		if !strings.HasPrefix(name, "vm.") {
+			return nil, fmt.Errorf("unsupported section [%s]", name)
 		}
-		// No support for recursive replacement or missing vars
-		if strings.Contains(val, "$") {
-			return fmt.Errorf("%s=%s is recursive or missing",
-				key, val)
+		vmIndex, err := strconv.Atoi(strings.TrimPrefix(name, "vm."))
+		if err != nil || vmIndex < 1 {
+			return nil, fmt.Errorf("invalid VM section [%s]", name)
 		}
-		f[key] = val
+		vms[vmIndex] = sect.KeysHash()
 	}
-	return nil
+
+	return vms, nil
 }
 
 // Parse confPath as an ini/shell env and return the resulting RapidosConf struct
@@ -75,8 +88,7 @@ func ParseConf(confPath string, overlay map[string]string,
 	// parameters are requested via the accessor functions
 	conf.f = cfg.Section(ini.DEFAULT_SECTION).KeysHash()
 
-	// ideally NameMapper / ValueMapper could handle this in a single pass
-	err = parseConfExpand(conf.f)
+	conf.vms, err = parseConfVMSections(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +97,13 @@ func ParseConf(confPath string, overlay map[string]string,
 		conf.f[k] = v
 	}
 
+	// expand after applying the overlay, so that keys referring to an
+	// overlaid key pick up the new value. Overlay values are literal.
+	err = expandConf(conf.f, conf.vms, overlay)
+	if err != nil {
+		return nil, err
+	}
+
 	conf.Debug = debug
 	if conf.Debug {
 		conf.DumpConf()
@@ -180,8 +199,11 @@ func (conf *RapidosConf) getSourceKernImgPath() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	// TODO an x86-64 bzImage is currently assumed
-	kernImg := path.Join(kernelSrc, "/arch/x86/boot/bzImage")
+	a, err := conf.getArchDef()
+	if err != nil {
+		return "", err
+	}
+	kernImg := path.Join(kernelSrc, a.kernImg)
 
 	return kernImg, nil
 }
@@ -211,74 +233,473 @@ func (conf *RapidosConf) GetKernImgPath() (string, error) {
 }
 
 func (conf *RapidosConf) GetQEMUExtraArgs() ([]string, error) {
-	return strings.Split(conf.f["QEMU_EXTRA_ARGS"], " "), nil
+	return strings.Fields(conf.f["QEMU_EXTRA_ARGS"]), nil
+}
+
+func (conf *RapidosConf) GetKernelExtraArgs() ([]string, error) {
+	return strings.Fields(conf.f["KERNEL_EXTRA_ARGS"]), nil
+}
+
+// Return the NAMESERVERS DNS server addresses, used for all VMs
+func (conf *RapidosConf) GetNameservers() ([]string, error) {
+	var nameservers []string
+
+	for _, val := range strings.Fields(conf.f["NAMESERVERS"]) {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid NAMESERVERS address: %s",
+				val)
+		}
+		nameservers = append(nameservers, ip.String())
+	}
+	return nameservers, nil
+}
+
+// generate /etc/resolv.conf content for @nameservers
+func genResolvConf(nameservers []string) string {
+	resolv := "# generated by rapidos from rapidos.conf NAMESERVERS\n"
+	for _, ns := range nameservers {
+		resolv += "nameserver " + ns + "\n"
+	}
+	return resolv
+}
+
+const (
+	// VMs are connected to the rapidos bridge via per-VM tap devices
+	netModeBridge = "bridge"
+	// QEMU user-mode (slirp) networking, with no host prerequisites
+	netModeUser = "user"
+)
+
+func (conf *RapidosConf) GetNetMode() (string, error) {
+	switch conf.f["NET_MODE"] {
+	case "", netModeBridge:
+		return netModeBridge, nil
+	case netModeUser:
+		return netModeUser, nil
+	}
+	return "", fmt.Errorf("invalid NET_MODE: %s", conf.f["NET_MODE"])
+}
+
+// return the host port offset applied to user-mode forwarded guest ports
+func (conf *RapidosConf) getUserNetPortOffset() (int, error) {
+	if conf.f["NET_USER_PORT_OFFSET"] == "" {
+		return 0, nil
+	}
+	off, err := strconv.Atoi(conf.f["NET_USER_PORT_OFFSET"])
+	if err != nil || off < 0 {
+		return 0, fmt.Errorf("invalid NET_USER_PORT_OFFSET: %s",
+			conf.f["NET_USER_PORT_OFFSET"])
+	}
+	return off, nil
+}
+
+// parse the optional duration at conf @key, e.g. "10m". Zero if unset.
+func (conf *RapidosConf) getDuration(key string) (time.Duration, error) {
+	if conf.f[key] == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(conf.f[key])
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, conf.f[key])
+	}
+	return d, nil
+}
+
+// GetBootTimeout returns how long a VM may take to report that it's ready,
+// before being killed. Zero means no timeout.
+func (conf *RapidosConf) GetBootTimeout() (time.Duration, error) {
+	return conf.getDuration("BOOT_TIMEOUT")
+}
+
+// GetRunTimeout returns how long a VM may run for, before being killed. Zero
+// means no timeout.
+func (conf *RapidosConf) GetRunTimeout() (time.Duration, error) {
+	return conf.getDuration("RUN_TIMEOUT")
+}
+
+// parse the optional "0" / "1" flag at conf @key. False if unset.
+func (conf *RapidosConf) getBool(key string) (bool, error) {
+	switch conf.f[key] {
+	case "", "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid %s: %s", key, conf.f[key])
+}
+
+// GetWatchdog returns whether VMs should be provided with a watchdog device
+func (conf *RapidosConf) GetWatchdog() (bool, error) {
+	return conf.getBool("WATCHDOG")
+}
+
+// GetFailOnSplat returns whether kernel splats seen on the console of a
+// foreground VM should be treated as a failure
+func (conf *RapidosConf) GetFailOnSplat() (bool, error) {
+	return conf.getBool("FAIL_ON_SPLAT")
+}
+
+type RapidosConfBridge struct {
+	BrDev string
+	// following are optional
+	BrAddr       *net.IPNet
+	BrAddr6      *net.IPNet
+	BrIf         string
+	DHCPSrvRange string
+	TapUID       int
+}
+
+// Return the host bridge configuration used for NET_MODE="bridge"
+func (conf *RapidosConf) GetBridgeConf() (*RapidosConfBridge, error) {
+	var br RapidosConfBridge
+
+	br.BrDev = conf.f["BR_DEV"]
+	if br.BrDev == "" {
+		return nil, fmt.Errorf("BR_DEV not configured")
+	}
+
+	if conf.f["BR_ADDR"] != "" {
+		ip, ipNet, err := net.ParseCIDR(conf.f["BR_ADDR"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid BR_ADDR: %v", err)
+		}
+		ipNet.IP = ip
+		br.BrAddr = ipNet
+	}
+
+	if conf.f["BR_ADDR6"] != "" {
+		ip, ipNet, err := net.ParseCIDR(conf.f["BR_ADDR6"])
+		if err != nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid BR_ADDR6: %s",
+				conf.f["BR_ADDR6"])
+		}
+		ipNet.IP = ip
+		br.BrAddr6 = ipNet
+	}
+
+	br.BrIf = conf.f["BR_IF"]
+	br.DHCPSrvRange = conf.f["BR_DHCP_SRV_RANGE"]
+
+	tapUser := conf.f["TAP_USER"]
+	if tapUser == "" {
+		return nil, fmt.Errorf("TAP_USER not configured")
+	}
+	u, err := user.Lookup(tapUser)
+	if err != nil {
+		u, err = user.LookupId(tapUser)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TAP_USER: %s", tapUser)
+		}
+	}
+	br.TapUID, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &br, nil
 }
 
 type RapidosConfVM struct {
 	TapDev  string
 	MACAddr string
 	UseDHCP bool
-	// following could be empty if UseDHCP is true
-	IPAddr   string
-	Hostname string
+	// following could be empty if UseDHCP is true or IP6Addr is set
+	IPAddr      string
+	IPPrefixLen int
+	Hostname    string
+	// following are optional
+	Gateway      string
+	IP6Addr      string
+	IP6PrefixLen int
+	Gateway6     string
 }
 
-func (conf *RapidosConf) GetVMDef(vmIndex int) (*RapidosConfVM, error) {
-	var vmDef RapidosConfVM
+// rapidos.conf keys carrying RapidosConfVM values
+type vmConfKeys struct {
+	tapDev   string
+	macAddr  string
+	useDHCP  string
+	ipAddr   string
+	hostname string
+	gateway  string
+	ip6Addr  string
+	gateway6 string
+}
 
-	if vmIndex < 1 {
-		return nil, fmt.Errorf("invalid vmIndex %d", vmIndex)
+// keys used within a [vm.<index>] section
+var vmSectionKeys = vmConfKeys{
+	tapDev:   "tap",
+	macAddr:  "mac",
+	useDHCP:  "dhcp",
+	ipAddr:   "ip",
+	hostname: "hostname",
+	gateway:  "gateway",
+	ip6Addr:  "ip6",
+	gateway6: "gateway6",
+}
+
+// XXX legacy flat config syntax is particularly horrid; TAP_DEV uses
+// (vmIndex - 1) while everything else uses vmIndex!
+func vmLegacyKeys(vmIndex int) vmConfKeys {
+	return vmConfKeys{
+		tapDev:   "TAP_DEV" + strconv.Itoa(vmIndex-1),
+		macAddr:  "MAC_ADDR" + strconv.Itoa(vmIndex),
+		useDHCP:  "IP_ADDR" + strconv.Itoa(vmIndex) + "_DHCP",
+		ipAddr:   "IP_ADDR" + strconv.Itoa(vmIndex),
+		hostname: "HOSTNAME" + strconv.Itoa(vmIndex),
+		gateway:  "GATEWAY" + strconv.Itoa(vmIndex),
+		ip6Addr:  "IP6_ADDR" + strconv.Itoa(vmIndex),
+		gateway6: "GATEWAY6_" + strconv.Itoa(vmIndex),
+	}
+}
+
+// parse an "<address>[/<prefix length>]" VM address of family @v6, with the
+// prefix length defaulting to @defPrefixLen.
+func parseVMAddr(val string, v6 bool, defPrefixLen int) (string, int, error) {
+	addr := val
+	prefixLen := defPrefixLen
+	if i := strings.Index(val, "/"); i != -1 {
+		addr = val[:i]
+		maxLen := 32
+		if v6 {
+			maxLen = 128
+		}
+		var err error
+		prefixLen, err = strconv.Atoi(val[i+1:])
+		if err != nil || prefixLen < 1 || prefixLen > maxLen {
+			return "", 0, fmt.Errorf("invalid prefix length: %s", val)
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return "", 0, fmt.Errorf("invalid IP address: %s", val)
+	}
+	return ip.String(), prefixLen, nil
+}
+
+// parse a VM gateway address of family @v6
+func parseVMGateway(val string, v6 bool) (string, error) {
+	ip := net.ParseIP(val)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return "", fmt.Errorf("invalid gateway address: %s", val)
 	}
+	return ip.String(), nil
+}
 
-	// XXX config syntax is particularly horrid; TAP_DEV uses (vmIndex - 1)
-	// while everything else uses vmIndex!
-	// TODO: syntax should be fixed in future by moving to ini style
-	// hierarchical configuration with one ini section per VM.
-	confKey := "TAP_DEV" + strconv.Itoa(vmIndex-1)
-	vmDef.TapDev = conf.f[confKey]
+// fill a RapidosConfVM for VM @vmIndex from @f using @keys. @where prefixes
+// error messages.
+func parseVMDef(f map[string]string, keys vmConfKeys, vmIndex int,
+	where string) (*RapidosConfVM, error) {
+	var vmDef RapidosConfVM
 
+	vmDef.TapDev = f[keys.tapDev]
 	// could use net.InterfaceByName() for validation, but leave it up to
 	// qemu for now.
 	if vmDef.TapDev == "" {
-		return nil, fmt.Errorf("rapidos.conf missing %s\n", confKey)
+		return nil, fmt.Errorf("%s missing %s\n", where, keys.tapDev)
 	}
 
-	confKey = "MAC_ADDR" + strconv.Itoa(vmIndex)
-	vmDef.MACAddr = conf.f[confKey]
-	if vmDef.MACAddr == "" {
-		return nil, fmt.Errorf("rapidos.conf missing %s\n", confKey)
+	// generated below if unset, once the hostname is known
+	vmDef.MACAddr = f[keys.macAddr]
+	if vmDef.MACAddr != "" {
+		_, err := net.ParseMAC(vmDef.MACAddr)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s invalid: %v\n",
+				where, keys.macAddr, err)
+		}
 	}
 
-	confKey = "IP_ADDR" + strconv.Itoa(vmIndex) + "_DHCP"
-	if conf.f[confKey] == "" || conf.f[confKey] == "0" {
+	switch f[keys.useDHCP] {
+	case "", "0":
 		vmDef.UseDHCP = false
-	} else if conf.f[confKey] == "1" {
+	case "1":
 		vmDef.UseDHCP = true
-	} else {
-		return nil, fmt.Errorf("rapidos.conf %s invalid value: %s\n",
-			confKey, conf.f[confKey])
+	default:
+		return nil, fmt.Errorf("%s %s invalid value: %s\n",
+			where, keys.useDHCP, f[keys.useDHCP])
 	}
 
-	confKey = "IP_ADDR" + strconv.Itoa(vmIndex)
-	vmDef.IPAddr = conf.f[confKey]
-	if vmDef.IPAddr == "" && !vmDef.UseDHCP {
-		return nil, fmt.Errorf("rapidos.conf missing %s\n", confKey)
+	var err error
+	if f[keys.ipAddr] != "" {
+		vmDef.IPAddr, vmDef.IPPrefixLen, err =
+			parseVMAddr(f[keys.ipAddr], false, 24)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %v\n", where, keys.ipAddr,
+				err)
+		}
+	}
+	if f[keys.ip6Addr] != "" {
+		vmDef.IP6Addr, vmDef.IP6PrefixLen, err =
+			parseVMAddr(f[keys.ip6Addr], true, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %v\n", where, keys.ip6Addr,
+				err)
+		}
+	}
+	if vmDef.IPAddr == "" && vmDef.IP6Addr == "" && !vmDef.UseDHCP {
+		return nil, fmt.Errorf("%s missing %s\n", where, keys.ipAddr)
 	}
 
-	confKey = "HOSTNAME" + strconv.Itoa(vmIndex)
-	vmDef.Hostname = conf.f[confKey]
+	if f[keys.gateway] != "" {
+		if vmDef.IPAddr == "" {
+			return nil, fmt.Errorf("%s %s requires %s\n", where,
+				keys.gateway, keys.ipAddr)
+		}
+		vmDef.Gateway, err = parseVMGateway(f[keys.gateway], false)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %v\n", where, keys.gateway,
+				err)
+		}
+	}
+	if f[keys.gateway6] != "" {
+		if vmDef.IP6Addr == "" {
+			return nil, fmt.Errorf("%s %s requires %s\n", where,
+				keys.gateway6, keys.ip6Addr)
+		}
+		vmDef.Gateway6, err = parseVMGateway(f[keys.gateway6], true)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %v\n", where, keys.gateway6,
+				err)
+		}
+	}
+
+	vmDef.Hostname = f[keys.hostname]
 	if vmDef.Hostname == "" && !vmDef.UseDHCP {
-		return nil, fmt.Errorf("rapidos.conf missing %s\n", confKey)
+		return nil, fmt.Errorf("%s missing %s\n", where, keys.hostname)
+	}
+
+	if vmDef.MACAddr == "" {
+		vmDef.MACAddr = genMACAddr(getMACSeed(), vmIndex,
+			vmDef.Hostname)
 	}
 
 	return &vmDef, nil
 }
 
-func (conf *RapidosConf) GenGob() (*bytes.Buffer, error) {
+// Return the network configuration for VM @vmIndex. A [vm.<vmIndex>] section
+// takes precedence, with the legacy TAP_DEVn/MAC_ADDRn/... flat keys used as
+// a fallback. A MAC address is generated if not configured.
+func (conf *RapidosConf) GetVMDef(vmIndex int) (*RapidosConfVM, error) {
+	if vmIndex < 1 {
+		return nil, fmt.Errorf("invalid vmIndex %d", vmIndex)
+	}
+
+	if sect, ok := conf.vms[vmIndex]; ok {
+		return parseVMDef(sect, vmSectionKeys, vmIndex,
+			fmt.Sprintf("rapidos.conf [vm.%d]", vmIndex))
+	}
+
+	return parseVMDef(conf.f, vmLegacyKeys(vmIndex), vmIndex,
+		"rapidos.conf")
+}
+
+// Return the number of VMs with a network configuration. VM indices are
+// expected to be contiguous, starting at 1.
+func (conf *RapidosConf) NumVMDefs() int {
+	n := 0
+	for {
+		vmIndex := n + 1
+		_, haveSect := conf.vms[vmIndex]
+		haveLegacy := conf.f[vmLegacyKeys(vmIndex).tapDev] != ""
+		if !haveSect && !haveLegacy {
+			return n
+		}
+		n = vmIndex
+	}
+}
+
+// rapidos.conf keys consumed by uinit_common, which are embedded in every image
+var confGlobalKeys = []string{"DYN_DEBUG_MODULES", "DYN_DEBUG_FILES",
+	"UINIT_FAIL_POWEROFF", "WATCHDOG"}
+
+// return the subset of conf keys which are consumed by @m.
+func (conf *RapidosConf) manifestSubset(m *Manifest) map[string]string {
+	subset := make(map[string]string)
+	var wanted []string
+
+	wanted = append(wanted, confGlobalKeys...)
+	wanted = append(wanted, m.ConfRequired...)
+	wanted = append(wanted, m.ConfOptional...)
+	for _, key := range wanted {
+		if val, ok := conf.f[key]; ok {
+			subset[key] = val
+		}
+	}
+
+	return subset
+}
+
+// return the sorted conf keys which aren't carried in @subset
+func (conf *RapidosConf) droppedKeys(subset map[string]string) []string {
+	var dropped []string
+	for key := range conf.f {
+		if _, ok := subset[key]; !ok {
+			dropped = append(dropped, key)
+		}
+	}
+	sort.Strings(dropped)
+
+	return dropped
+}
+
+// return the hostname and static addresses of each VM with a network
+// configuration, using the legacy HOSTNAMEn, IP_ADDRn and IP6_ADDRn keys.
+// Addresses are normalized and carry no prefix length. VMs which don't have a
+// hostname are skipped.
+func (conf *RapidosConf) vmDefsSubset() (map[string]string, error) {
+	subset := make(map[string]string)
+
+	for vmIndex := 1; vmIndex <= conf.NumVMDefs(); vmIndex++ {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			return nil, err
+		}
+		if vmDef.Hostname == "" {
+			continue
+		}
+		keys := vmLegacyKeys(vmIndex)
+		subset[keys.hostname] = vmDef.Hostname
+		if vmDef.IPAddr != "" {
+			subset[keys.ipAddr] = vmDef.IPAddr
+		}
+		if vmDef.IP6Addr != "" {
+			subset[keys.ip6Addr] = vmDef.IP6Addr
+		}
+	}
+
+	return subset, nil
+}
+
+// Generate a gob encoded conf map for embedding in an image for @m. Only the
+// global keys and those declared by the manifest are included, alongside VM
+// definitions if requested via m.ConfVMDefs.
+func (conf *RapidosConf) GenGob(m *Manifest) (*bytes.Buffer, error) {
 	var b bytes.Buffer
 	e := gob.NewEncoder(&b)
 
-	err := e.Encode(conf.f)
+	subset := conf.manifestSubset(m)
+	if m.ConfVMDefs {
+		vmSubset, err := conf.vmDefsSubset()
+		if err != nil {
+			return nil, err
+		}
+		for key, val := range vmSubset {
+			subset[key] = val
+		}
+	}
+	if conf.Debug {
+		var embedded []string
+		for key := range subset {
+			embedded = append(embedded, key)
+		}
+		sort.Strings(embedded)
+		log.Printf("embedding conf keys: %v\n", embedded)
+		log.Printf("dropping conf keys: %v\n", conf.droppedKeys(subset))
+	}
+
+	err := e.Encode(subset)
 	if err != nil {
 		return nil, err
 	}
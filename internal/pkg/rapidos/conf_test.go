@@ -0,0 +1,187 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVMDefAddrs(t *testing.T) {
+	tests := []struct {
+		name        string
+		sect        map[string]string
+		nameservers []string
+		kernIP      string
+		wantErr     bool
+	}{
+		{
+			name:   "IPv4 default prefix",
+			sect:   map[string]string{"ip": "192.168.155.101"},
+			kernIP: "ip=192.168.155.101:::255.255.255.0:vm",
+		},
+		{
+			name: "IPv4 prefix and gateway",
+			sect: map[string]string{"ip": "10.1.2.3/16",
+				"gateway": "10.1.0.1"},
+			kernIP: "ip=10.1.2.3::10.1.0.1:255.255.0.0:vm",
+		},
+		{
+			name: "IPv4 nameservers",
+			sect: map[string]string{"ip": "10.1.2.3/16",
+				"gateway": "10.1.0.1"},
+			nameservers: []string{"fd00::53", "10.1.0.53",
+				"10.2.0.53", "10.3.0.53"},
+			kernIP: "ip=10.1.2.3::10.1.0.1:255.255.0.0:vm::off:" +
+				"10.1.0.53:10.2.0.53",
+		},
+		{
+			name: "dual stack",
+			sect: map[string]string{"ip": "192.168.155.101",
+				"ip6": "fd00:155::101", "gateway6": "fd00:155::1"},
+			kernIP: "ip=192.168.155.101:::255.255.255.0:vm " +
+				"rapidos.ip6=fd00:155::101/64 " +
+				"rapidos.gw6=fd00:155::1",
+		},
+		{
+			name: "IPv6 only",
+			sect: map[string]string{"ip6": "fd00:155::101/112"},
+			kernIP: "ip=none rapidos.hostname=vm " +
+				"rapidos.ip6=fd00:155::101/112",
+		},
+		{
+			name:    "IPv6 in ip",
+			sect:    map[string]string{"ip": "fd00:155::101"},
+			wantErr: true,
+		},
+		{
+			name:    "bad prefix",
+			sect:    map[string]string{"ip6": "fd00:155::101/129"},
+			wantErr: true,
+		},
+		{
+			name: "gateway without address",
+			sect: map[string]string{"ip6": "fd00:155::101",
+				"gateway": "10.0.0.1"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		test.sect["tap"] = "tap0"
+		test.sect["hostname"] = "vm"
+		conf := &RapidosConf{
+			f:   map[string]string{},
+			vms: map[int]map[string]string{1: test.sect},
+		}
+		vmDef, err := conf.GetVMDef(1)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetVMDef failed: %v", test.name, err)
+			continue
+		}
+		kernIP := getKernIPArgs(vmDef, test.nameservers)
+		if kernIP != test.kernIP {
+			t.Errorf("%s: got %q, want %q", test.name, kernIP,
+				test.kernIP)
+		}
+	}
+}
+
+func TestVMDefsSubset(t *testing.T) {
+	conf := &RapidosConf{
+		f: map[string]string{
+			// legacy VM 1 definition
+			"TAP_DEV0":  "tap0",
+			"IP_ADDR1":  "192.168.155.101/24",
+			"HOSTNAME1": "vm1",
+		},
+		vms: map[int]map[string]string{
+			2: {"tap": "tap1", "ip6": "fd00:155:0::102/64",
+				"hostname": "vm2"},
+			// DHCP without hostname is skipped
+			3: {"tap": "tap2", "dhcp": "1"},
+		},
+	}
+
+	subset, err := conf.vmDefsSubset()
+	if err != nil {
+		t.Fatalf("vmDefsSubset failed: %v", err)
+	}
+	want := map[string]string{
+		"HOSTNAME1": "vm1",
+		"IP_ADDR1":  "192.168.155.101",
+		"HOSTNAME2": "vm2",
+		"IP6_ADDR2": "fd00:155::102",
+	}
+	if !reflect.DeepEqual(subset, want) {
+		t.Errorf("got %v, want %v", subset, want)
+	}
+}
+
+func TestDroppedKeys(t *testing.T) {
+	conf := &RapidosConf{
+		f: map[string]string{
+			"KERNEL_SRC": "/src",
+			"TAP_DEV0":   "tap0",
+			"HOSTNAME1":  "vm1",
+			"IP_ADDR1":   "192.168.155.101/24",
+			"CEPH_CONF":  "/etc/ceph/ceph.conf",
+		},
+	}
+	m := &Manifest{ConfRequired: []string{"CEPH_CONF"}, ConfVMDefs: true}
+
+	subset := conf.manifestSubset(m)
+	vmSubset, err := conf.vmDefsSubset()
+	if err != nil {
+		t.Fatalf("vmDefsSubset failed: %v", err)
+	}
+	for key, val := range vmSubset {
+		subset[key] = val
+	}
+	dropped := conf.droppedKeys(subset)
+	want := []string{"KERNEL_SRC", "TAP_DEV0"}
+	if !reflect.DeepEqual(dropped, want) {
+		t.Errorf("got %v, want %v", dropped, want)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	conf := &RapidosConf{f: map[string]string{"BOOT_TIMEOUT": "90s",
+		"RUN_TIMEOUT": "bogus"}}
+	d, err := conf.GetBootTimeout()
+	if err != nil || d != time.Duration(90*time.Second) {
+		t.Errorf("unexpected boot timeout %v: %v", d, err)
+	}
+	_, err = conf.GetRunTimeout()
+	if err == nil {
+		t.Errorf("expected error for invalid RUN_TIMEOUT")
+	}
+
+	conf.f["RUN_TIMEOUT"] = "-1m"
+	_, err = conf.GetRunTimeout()
+	if err == nil {
+		t.Errorf("expected error for negative RUN_TIMEOUT")
+	}
+
+	delete(conf.f, "RUN_TIMEOUT")
+	d, err = conf.GetRunTimeout()
+	if err != nil || d != 0 {
+		t.Errorf("unexpected unset run timeout %v: %v", d, err)
+	}
+}
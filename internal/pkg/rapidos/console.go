@@ -0,0 +1,147 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// optional printk timestamp and caller prefix of kernel console messages,
+// e.g. "[   12.345678]" or "[   12.345678][    T1]"
+const kmsgPrefix = `^(\[ *[0-9]+\.[0-9]+\])?(\[ *[TC][0-9]+\])? ?`
+
+// panics are matched even within another splat's trace
+var panicPattern = regexp.MustCompile("Kernel panic - not syncing")
+
+// console messages which indicate a kernel splat, checked in order. Generic
+// BUG and Oops messages are anchored, so that they aren't matched in
+// userspace output.
+var splatPatterns = []struct {
+	kind  string
+	match *regexp.Regexp
+}{
+	{"panic", panicPattern},
+	{"KASAN", regexp.MustCompile(kmsgPrefix + "BUG: KASAN: ")},
+	{"lockdep", regexp.MustCompile(
+		"WARNING: possible circular locking dependency")},
+	{"lockdep", regexp.MustCompile(
+		"WARNING: possible recursive locking detected")},
+	{"lockdep", regexp.MustCompile("WARNING: inconsistent lock state")},
+	{"lockdep", regexp.MustCompile("WARNING: suspicious RCU usage")},
+	// arm64 prefixes Oops with "Internal error: "
+	{"Oops", regexp.MustCompile(kmsgPrefix + "(Internal error: )?Oops: ")},
+	{"BUG", regexp.MustCompile(kmsgPrefix + "BUG: ")},
+}
+
+const (
+	// marks the end of an Oops, BUG, etc. trace
+	splatEndMarker = "---[ end "
+	// traces without an end marker are cut off after this many lines
+	splatMaxLines = 64
+)
+
+// ConsoleSplat is a kernel splat found in VM console output
+type ConsoleSplat struct {
+	Kind string
+	Line string
+}
+
+// consoleScanner is an io.Writer which scans VM console output for kernel
+// splats, retaining the trace of the first one found.
+type consoleScanner struct {
+	partial    string
+	splats     []ConsoleSplat
+	firstTrace []string
+	// number of lines seen for the current splat, zero if none
+	splatLines int
+}
+
+func (s *consoleScanner) scanLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	endMarker := strings.Contains(line, splatEndMarker)
+	// a panic is a new splat, as KASAN reports, etc. may lack an end marker
+	newPanic := panicPattern.MatchString(line) && !endMarker
+	if s.splatLines > 0 && !newPanic {
+		s.splatLines++
+		if len(s.splats) == 1 {
+			s.firstTrace = append(s.firstTrace, line)
+		}
+		// follow-on messages are considered part of the same splat
+		if endMarker || s.splatLines >= splatMaxLines {
+			s.splatLines = 0
+		}
+		return
+	} else if endMarker {
+		return
+	}
+
+	for _, p := range splatPatterns {
+		if !p.match.MatchString(line) {
+			continue
+		}
+		s.splats = append(s.splats, ConsoleSplat{Kind: p.kind,
+			Line: strings.TrimSpace(line)})
+		if len(s.splats) == 1 {
+			s.firstTrace = []string{line}
+		}
+		s.splatLines = 1
+		return
+	}
+}
+
+func (s *consoleScanner) Write(p []byte) (int, error) {
+	s.partial += string(p)
+	for {
+		i := strings.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.scanLine(s.partial[:i])
+		s.partial = s.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// return the first splat of @kind, or nil if none was seen
+func (s *consoleScanner) find(kind string) *ConsoleSplat {
+	for i := range s.splats {
+		if s.splats[i].Kind == kind {
+			return &s.splats[i]
+		}
+	}
+	return nil
+}
+
+// return a summary of any splats seen on the console of VM @vmIndex, logged at
+// @logPath, or an empty string if none were found
+func (s *consoleScanner) summary(vmIndex int, logPath string) string {
+	if len(s.splats) == 0 {
+		return ""
+	}
+
+	var kinds []string
+	for _, splat := range s.splats {
+		found := false
+		for _, k := range kinds {
+			found = found || k == splat.Kind
+		}
+		if !found {
+			kinds = append(kinds, splat.Kind)
+		}
+	}
+	return fmt.Sprintf("VM %d console: %d kernel splat(s) detected (%s), "+
+		"see %s\nfirst trace:\n%s\n", vmIndex, len(s.splats),
+		strings.Join(kinds, ", "), logPath,
+		strings.Join(s.firstTrace, "\n"))
+}
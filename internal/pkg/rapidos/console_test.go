@@ -0,0 +1,117 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConsoleScanner(t *testing.T) {
+	var s consoleScanner
+
+	if s.summary(1, "vm1.log") != "" {
+		t.Errorf("unexpected summary without splats")
+	}
+
+	console := "[    0.000000] Linux version 5.2.0\r\n" +
+		"[   12.000001] BUG: unable to handle page fault for address: 0\r\n" +
+		"[   12.000002] Oops: 0000 [#1] SMP NOPTI\r\n" +
+		"[   12.000003] RIP: 0010:xfs_foo+0x1/0x2\r\n" +
+		"[   12.000004] ---[ end trace 0123456789abcdef ]---\r\n" +
+		"[   12.000005] Kernel panic - not syncing: Fatal exception\r\n" +
+		"[   12.000006] ---[ end Kernel panic - not syncing: Fatal " +
+		"exception ]---\r\n" +
+		"[   12.000007] ---[ end Kernel panic - not syncing: Fatal ex"
+	// written in pieces, splitting lines
+	for len(console) > 0 {
+		n := 7
+		if n > len(console) {
+			n = len(console)
+		}
+		s.Write([]byte(console[:n]))
+		console = console[n:]
+	}
+
+	if len(s.splats) != 2 || s.splats[0].Kind != "BUG" ||
+		s.splats[1].Kind != "panic" {
+		t.Fatalf("unexpected splats: %+v", s.splats)
+	}
+	// Oops is part of the BUG trace, up to the end marker
+	if len(s.firstTrace) != 4 ||
+		!strings.Contains(s.firstTrace[2], "RIP") {
+		t.Errorf("unexpected first trace: %q", s.firstTrace)
+	}
+	p := s.find("panic")
+	if p == nil || !strings.HasSuffix(p.Line, "Fatal exception") {
+		t.Errorf("unexpected panic splat: %+v", p)
+	}
+	if s.find("KASAN") != nil {
+		t.Errorf("unexpected KASAN splat")
+	}
+
+	summary := s.summary(1, "vm1.log")
+	if !strings.Contains(summary, "2 kernel splat(s) detected (BUG, panic)") ||
+		!strings.Contains(summary, "xfs_foo") {
+		t.Errorf("unexpected summary: %s", summary)
+	}
+}
+
+func TestConsoleScannerKinds(t *testing.T) {
+	tests := []struct {
+		line string
+		kind string
+	}{
+		{"[    1.000000] BUG: KASAN: use-after-free in foo+0x10/0x20",
+			"KASAN"},
+		{"[    1.0] WARNING: possible circular locking dependency " +
+			"detected", "lockdep"},
+		{"[    1.000000] Internal error: Oops: 96000004 [#1] SMP",
+			"Oops"},
+		{"[    1.000000] BUG: scheduling while atomic: foo/1/0x00000002",
+			"BUG"},
+		{"[    1.000000][    T1] BUG: unable to handle page fault", "BUG"},
+		{"Oops: 0000 [#1] SMP NOPTI", "Oops"},
+		{"[    1.0] WARNING: CPU: 0 PID: 1 at fs/foo.c:1", ""},
+		// userspace output mentioning splats
+		{"xfs/123 0s ... BUG: KASAN: mismatch, see 123.out.bad", ""},
+		{"grep -c 'Oops: ' dmesg.out", ""},
+		{"SUBSYS BUG: 1 test failed", ""},
+	}
+
+	for _, test := range tests {
+		var s consoleScanner
+		s.Write([]byte(test.line + "\n"))
+		kind := ""
+		if len(s.splats) > 0 {
+			kind = s.splats[0].Kind
+		}
+		if kind != test.kind {
+			t.Errorf("%q: got kind %q, expected %q", test.line, kind,
+				test.kind)
+		}
+	}
+}
+
+// KASAN reports have no end marker, so a following panic mustn't be taken as
+// part of the KASAN trace
+func TestConsoleScannerPanicInSplat(t *testing.T) {
+	var s consoleScanner
+
+	s.Write([]byte("[    5.000001] BUG: KASAN: slab-out-of-bounds in foo\n" +
+		"[    5.000002] Read of size 8 at addr ffff888000000000\n" +
+		"[    5.000003] Kernel panic - not syncing: panic_on_warn set\n"))
+	if len(s.splats) != 2 || s.splats[0].Kind != "KASAN" ||
+		s.find("panic") == nil {
+		t.Errorf("unexpected splats: %+v", s.splats)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 
 	"github.com/u-root/u-root/pkg/cpio"
 	"github.com/u-root/u-root/pkg/golang"
@@ -24,6 +25,12 @@ import (
 	"github.com/u-root/u-root/pkg/uroot/initramfs"
 )
 
+// default shell for all images, see inits/run_shell
+const runShellPkg = "gitlab.com/rapidos/rapidos/inits/run_shell"
+
+// services the WATCHDOG device, see inits/watchdogd
+const watchdogdPkg = "gitlab.com/rapidos/rapidos/inits/watchdogd"
+
 func Cut(conf *RapidosConf, m *Manifest, rdir string,
 	imgPath string) error {
 	var files []string
@@ -31,7 +38,9 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 
 	// finalize inventory if init provided an optional callback
-	err = RenderManifest(*conf, m)
+	cbConf := *conf
+	cbConf.ImgDir = path.Dir(imgPath)
+	err = RenderManifest(cbConf, m)
 	if err != nil {
 		return err
 	}
@@ -43,6 +52,30 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 		}
 	}
 
+	// needed for uinit results, but may be builtin or unavailable
+	resultsKmods, err := FindKmods(conf, []string{"virtio_console"})
+	if err != nil {
+		if conf.Debug {
+			logger.Printf("results channel kmod not found: %v\n", err)
+		}
+	} else {
+		files = append(files, resultsKmods...)
+	}
+
+	watchdog, err := conf.GetWatchdog()
+	if err != nil {
+		return err
+	}
+	var watchdogPkgs []string
+	if watchdog {
+		wdKmods, err := FindKmods(conf, []string{"i6300esb"})
+		if err != nil {
+			return fmt.Errorf("WATCHDOG kmod not found: %v", err)
+		}
+		files = append(files, wdKmods...)
+		watchdogPkgs = append(watchdogPkgs, watchdogdPkg)
+	}
+
 	if len(m.Inventory.Bins) > 0 {
 		bins, err := FindBins(m.Inventory.Bins,
 			false) // ignoreMissing=false
@@ -57,12 +90,21 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 	}
 
 	// u-root's base "init" is responsible for invoking the manifest
-	// specific "uinit", and subsequently interactive shell (rush)
+	// specific "uinit", and subsequently run_shell, which runs any -run
+	// command or execs the interactive shell (rush)
 	pkgs := append(m.Inventory.Pkgs, "github.com/u-root/u-root/cmds/core/init",
-			m.Inventory.Init)
+			m.Inventory.Init, runShellPkg)
+	pkgs = append(pkgs, watchdogPkgs...)
+
+	arch, err := conf.GetArch()
+	if err != nil {
+		return err
+	}
 
 	env := golang.Default()
 	env.CgoEnabled = false
+	// build initramfs binaries for the kernel architecture
+	env.GOARCH = archs[arch].goarch
 
 	var b builder.Builder
 	switch m.Builder {
@@ -74,6 +116,11 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 		return fmt.Errorf("unsupported builder type %s", m.Builder)
 	}
 
+	defaultShell, err := getDefaultShell(m.Builder)
+	if err != nil {
+		return err
+	}
+
 	archiver, err := initramfs.GetArchiver("cpio")
 	if err != nil {
 		return err
@@ -85,8 +132,13 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// XXX write a subset of conf based on manifest?
-	confGob, err := conf.GenGob()
+	// only the subset of conf used by the manifest is embedded
+	confGob, err := conf.GenGob(m)
+	if err != nil {
+		return err
+	}
+
+	nameservers, err := conf.GetNameservers()
 	if err != nil {
 		return err
 	}
@@ -104,7 +156,7 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 	}
 
 	// similar to the existing default, but drops resolv.conf, etc.
-	base := cpio.ArchiveFromRecords([]cpio.Record{
+	baseRecords := []cpio.Record{
 		cpio.Directory("etc", 0755),
 		cpio.Directory("dev", 0755),
 		cpio.Directory("tmp", 0777),
@@ -121,7 +173,13 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 		cpio.CharDev("dev/urandom", 0666, 1, 9),
 
 		cpio.StaticFile("rapidos.conf.bin", confGob.String(), 0600),
-	})
+	}
+	// resolv.conf is only generated if explicitly configured
+	if len(nameservers) > 0 {
+		baseRecords = append(baseRecords, cpio.StaticFile(
+			"etc/resolv.conf", genResolvConf(nameservers), 0644))
+	}
+	base := cpio.ArchiveFromRecords(baseRecords)
 
 	opts := uroot.Opts{
 		TempDir: tmpDir,
@@ -137,7 +195,7 @@ func Cut(conf *RapidosConf, m *Manifest, rdir string,
 		// TODO: use a manifest specific initcmd, rather than relying
 		// on the init->uinit functionality?
 		InitCmd:      "init",
-		DefaultShell: "/bbin/rush",
+		DefaultShell: defaultShell,
 		BaseArchive:  base.Reader(),
 	}
 
@@ -0,0 +1,44 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"testing"
+)
+
+func TestDefaultShell(t *testing.T) {
+	tests := []struct {
+		builder string
+		shell   string
+	}{
+		{"bb", "/bbin/run_shell"},
+		// etcd, minio and prometheus
+		{"binary", "/bin/run_shell"},
+		{"source", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		shell, err := getDefaultShell(test.builder)
+		if test.shell == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", test.builder,
+					shell)
+			}
+			continue
+		}
+		if err != nil || shell != test.shell {
+			t.Errorf("%q: expected %s, got %s: %v", test.builder,
+				test.shell, shell, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/dhcp"
+)
+
+// the DHCP server pidfile and lease table are kept alongside the VM pidfiles
+func getDHCPPidPath(pidsDir string) string {
+	return path.Join(pidsDir, "rapidos_dhcp.pid")
+}
+
+func getDHCPLeasesPath(pidsDir string) string {
+	return path.Join(pidsDir, "rapidos_dhcp_leases.json")
+}
+
+// parse a BR_DHCP_SRV_RANGE value, e.g. "192.168.155.10,192.168.155.20,12h".
+// The lease time is optional and defaults to one hour.
+func parseDHCPRange(val string) (net.IP, net.IP, time.Duration, error) {
+	leaseTime := time.Duration(time.Hour)
+
+	s := strings.Split(val, ",")
+	if len(s) < 2 || len(s) > 3 {
+		return nil, nil, 0, fmt.Errorf("invalid BR_DHCP_SRV_RANGE: %s",
+			val)
+	}
+	start := net.ParseIP(strings.TrimSpace(s[0]))
+	end := net.ParseIP(strings.TrimSpace(s[1]))
+	if start.To4() == nil || end.To4() == nil {
+		return nil, nil, 0, fmt.Errorf("invalid BR_DHCP_SRV_RANGE "+
+			"address: %s", val)
+	}
+	if len(s) == 3 {
+		var err error
+		leaseTime, err = time.ParseDuration(strings.TrimSpace(s[2]))
+		if err != nil || leaseTime < time.Minute {
+			return nil, nil, 0, fmt.Errorf("invalid "+
+				"BR_DHCP_SRV_RANGE lease time: %s", s[2])
+		}
+	}
+	return start, end, leaseTime, nil
+}
+
+// DHCPEnabled returns true if the rapidos bridge should be served by the
+// built-in DHCP server
+func (conf *RapidosConf) DHCPEnabled() bool {
+	return conf.f["BR_DHCP_SRV_RANGE"] != ""
+}
+
+// build a DHCP server config from the rapidos.conf bridge and VM parameters.
+// Each VM with a configured IP address is given a static lease.
+func (conf *RapidosConf) getDHCPConfig() (*dhcp.Config, error) {
+	br, err := conf.GetBridgeConf()
+	if err != nil {
+		return nil, err
+	}
+	if br.BrAddr == nil || br.BrAddr.IP.To4() == nil {
+		return nil, fmt.Errorf("DHCP server requires an IPv4 BR_ADDR")
+	}
+	c := dhcp.Config{ServerIP: br.BrAddr.IP, Mask: br.BrAddr.Mask}
+
+	c.RangeStart, c.RangeEnd, c.LeaseTime, err =
+		parseDHCPRange(br.DHCPSrvRange)
+	if err != nil {
+		return nil, err
+	}
+
+	nameservers, err := conf.GetNameservers()
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range nameservers {
+		// clients are only provided with IPv4 DNS servers
+		if ip := net.ParseIP(ns); ip.To4() != nil {
+			c.DNS = append(c.DNS, ip)
+		}
+	}
+
+	for vmIndex := 1; vmIndex <= conf.NumVMDefs(); vmIndex++ {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			return nil, err
+		}
+		if vmDef.IPAddr == "" {
+			continue
+		}
+		mac, _ := net.ParseMAC(vmDef.MACAddr) // validated by GetVMDef
+		hostname := vmDef.Hostname
+		if hostname == "" {
+			hostname = "rapido" + strconv.Itoa(vmIndex)
+		}
+		c.Static = append(c.Static, dhcp.StaticLease{
+			MAC:      mac,
+			IP:       net.ParseIP(vmDef.IPAddr),
+			Hostname: hostname,
+		})
+	}
+
+	return &c, nil
+}
+
+func writeDHCPLeases(pidsDir string, leases []dhcp.Lease) {
+	b, err := json.MarshalIndent(leases, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(getDHCPLeasesPath(pidsDir), b, 0644)
+	}
+	if err != nil {
+		log.Printf("failed to write DHCP lease table: %v\n", err)
+	}
+}
+
+// ServeDHCP runs the built-in DHCP server on BR_DEV until SIGINT or SIGTERM.
+// The server pidfile and lease table are written to @pidsDir.
+func ServeDHCP(conf *RapidosConf, pidsDir string) error {
+	br, err := conf.GetBridgeConf()
+	if err != nil {
+		return err
+	}
+	c, err := conf.getDHCPConfig()
+	if err != nil {
+		return err
+	}
+	c.OnChange = func(leases []dhcp.Lease) {
+		writeDHCPLeases(pidsDir, leases)
+	}
+	s, err := dhcp.NewServer(*c)
+	if err != nil {
+		return err
+	}
+
+	pidPath := getDHCPPidPath(pidsDir)
+	running, err := checkQEMUProc(pidPath)
+	if err != nil {
+		return err
+	}
+	if running {
+		return fmt.Errorf("DHCP server already running")
+	}
+
+	conn, err := dhcp.Listen(br.BrDev)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(pidPath,
+		[]byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer os.Remove(pidPath)
+	defer os.Remove(getDHCPLeasesPath(pidsDir))
+	writeDHCPLeases(pidsDir, nil)
+
+	sigs := make(chan os.Signal, 1)
+	stopping := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		close(stopping)
+		conn.Close()
+	}()
+
+	log.Printf("DHCP server listening on %s\n", br.BrDev)
+	err = s.Serve(conn)
+	select {
+	case <-stopping:
+		return nil
+	default:
+		// Serve() failed without a signal
+		return err
+	}
+}
+
+// StopDHCP sends SIGTERM to any DHCP server running for @pidsDir
+func StopDHCP(pidsDir string) error {
+	pidPath := getDHCPPidPath(pidsDir)
+	// single pid line, same as QEMU
+	pid, err := readQEMUPid(pidPath)
+	if err != nil || pid == 0 {
+		return err
+	}
+	err = syscall.Kill(pid, syscall.SIGTERM)
+	if err == syscall.ESRCH {
+		os.Remove(getDHCPLeasesPath(pidsDir))
+		return os.Remove(pidPath)
+	}
+	return err
+}
+
+// ListDHCPLeases returns the lease table of the DHCP server running for
+// @pidsDir, or nil if no server is running.
+func ListDHCPLeases(pidsDir string) ([]dhcp.Lease, error) {
+	running, err := checkQEMUProc(getDHCPPidPath(pidsDir))
+	if err != nil || !running {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(getDHCPLeasesPath(pidsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var leases []dhcp.Lease
+	err = json.Unmarshal(b, &leases)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHCP lease table: %v", err)
+	}
+	return leases, nil
+}
@@ -0,0 +1,43 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDHCPRange(t *testing.T) {
+	start, end, leaseTime, err :=
+		parseDHCPRange("192.168.155.10,192.168.155.20,12h")
+	if err != nil {
+		t.Fatalf("failed to parse range: %v", err)
+	}
+	if start.String() != "192.168.155.10" ||
+		end.String() != "192.168.155.20" ||
+		leaseTime != time.Duration(12*time.Hour) {
+		t.Fatalf("unexpected range: %v %v %v", start, end, leaseTime)
+	}
+
+	_, _, leaseTime, err = parseDHCPRange("10.0.0.1, 10.0.0.2")
+	if err != nil || leaseTime != time.Duration(time.Hour) {
+		t.Fatalf("unexpected default lease time: %v %v", leaseTime, err)
+	}
+
+	for _, bad := range []string{"10.0.0.1", "10.0.0.1,fe80::1",
+		"10.0.0.1,10.0.0.2,12x", "10.0.0.1,10.0.0.2,1s", "a,b,c,d"} {
+		_, _, _, err = parseDHCPRange(bad)
+		if err == nil {
+			t.Fatalf("invalid range %s parsed successfully", bad)
+		}
+	}
+}
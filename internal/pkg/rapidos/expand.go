@@ -0,0 +1,260 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// confExpander performs shell style variable expansion for rapidos.conf
+// values. $VAR and ${VAR} are replaced with the value of VAR, while
+// ${VAR:-default} is replaced with the (expanded) default if VAR is unset or
+// empty. \$ gives a literal '$'.
+// VAR is looked up in the rapidos.conf map first, then in the environment.
+// Values referencing other keys are expanded recursively, regardless of the
+// order in which they appear.
+type confExpander struct {
+	// raw (unexpanded) key=val map
+	raw map[string]string
+	// keys whose values are used as-is, without expansion
+	literal map[string]string
+	// keys which have already been fully expanded
+	done map[string]string
+	// keys currently being expanded, used for cycle detection
+	stack []string
+}
+
+func newConfExpander(raw map[string]string,
+	literal map[string]string) *confExpander {
+	return &confExpander{
+		raw:     raw,
+		literal: literal,
+		done:    make(map[string]string),
+	}
+}
+
+// expand all global keys in @f and per-VM keys in @vms in place. Keys in
+// @literal, e.g. -C overlay values which have already been through the shell,
+// aren't expanded, but can be referred to by other keys.
+func expandConf(f map[string]string, vms map[int]map[string]string,
+	literal map[string]string) error {
+	e := newConfExpander(f, literal)
+
+	// sort for deterministic error reporting
+	var keys []string
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		_, err := e.expandKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for vmIndex, sect := range vms {
+		for key, val := range sect {
+			name := fmt.Sprintf("[vm.%d] %s", vmIndex, key)
+			val, err := e.expandOther(name, val)
+			if err != nil {
+				return err
+			}
+			sect[key] = val
+		}
+	}
+
+	for key, val := range e.done {
+		f[key] = val
+	}
+	return nil
+}
+
+func (e *confExpander) expandKey(key string) (string, error) {
+	if val, ok := e.done[key]; ok {
+		return val, nil
+	}
+	if val, ok := e.literal[key]; ok {
+		e.done[key] = val
+		return val, nil
+	}
+
+	for i, k := range e.stack {
+		if k == key {
+			cycle := append(append([]string{}, e.stack[i:]...), key)
+			return "", fmt.Errorf("variable expansion cycle: %s",
+				strings.Join(cycle, " -> "))
+		}
+	}
+
+	e.stack = append(e.stack, key)
+	val, err := e.expandVal(e.raw[key])
+	e.stack = e.stack[:len(e.stack)-1]
+	if err != nil {
+		return "", err
+	}
+
+	e.done[key] = val
+	return val, nil
+}
+
+// expand a value which doesn't correspond to a key in the raw map, e.g. a
+// per-VM section value. @name is only used for error reporting.
+func (e *confExpander) expandOther(name string, val string) (string, error) {
+	e.stack = append(e.stack, name)
+	val, err := e.expandVal(val)
+	e.stack = e.stack[:len(e.stack)-1]
+	return val, err
+}
+
+// return the value for @name and whether it is set
+func (e *confExpander) lookup(name string) (string, bool, error) {
+	if _, ok := e.raw[name]; ok {
+		val, err := e.expandKey(name)
+		return val, true, err
+	}
+	val, ok := os.LookupEnv(name)
+	return val, ok, nil
+}
+
+func isVarNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+func (e *confExpander) curKey() string {
+	if len(e.stack) == 0 {
+		return "rapidos.conf"
+	}
+	return e.stack[len(e.stack)-1]
+}
+
+// find the '}' closing a "${" which starts at @val[0]
+func findExpandClose(val string) int {
+	depth := 0
+	for i := 0; i < len(val); i++ {
+		switch {
+		case val[i] == '\\' && i+1 < len(val) && val[i+1] == '$':
+			i++
+		case val[i] == '$' && i+1 < len(val) && val[i+1] == '{':
+			depth++
+			i++
+		case val[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (e *confExpander) expandBraced(inner string) (string, error) {
+	name := inner
+	def := ""
+	hasDef := false
+	if i := strings.Index(inner, ":-"); i >= 0 {
+		name = inner[:i]
+		def = inner[i+2:]
+		hasDef = true
+	}
+
+	if name == "" || !isVarNameChar(name[0], true) {
+		return "", fmt.Errorf("%s: bad substitution ${%s}",
+			e.curKey(), inner)
+	}
+	for i := 1; i < len(name); i++ {
+		if !isVarNameChar(name[i], false) {
+			return "", fmt.Errorf("%s: bad substitution ${%s}",
+				e.curKey(), inner)
+		}
+	}
+
+	val, isSet, err := e.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if hasDef && val == "" {
+		return e.expandVal(def)
+	}
+	if !isSet {
+		return "", fmt.Errorf("%s references undefined variable %s",
+			e.curKey(), name)
+	}
+	return val, nil
+}
+
+func (e *confExpander) expandVal(val string) (string, error) {
+	// fast path if no variable to expand
+	if !strings.Contains(val, "$") {
+		return val, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(val); {
+		c := val[i]
+		if c == '\\' && i+1 < len(val) && val[i+1] == '$' {
+			b.WriteByte('$')
+			i += 2
+			continue
+		}
+		if c != '$' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+
+		if i+1 < len(val) && val[i+1] == '{' {
+			end := findExpandClose(val[i:])
+			if end < 0 {
+				return "", fmt.Errorf("%s: unterminated ${ in %q",
+					e.curKey(), val)
+			}
+			sub, err := e.expandBraced(val[i+2 : i+end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(sub)
+			i += end + 1
+			continue
+		}
+
+		j := i + 1
+		for j < len(val) && isVarNameChar(val[j], j == i+1) {
+			j++
+		}
+		if j == i+1 {
+			// not followed by a variable name, keep as literal
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		sub, isSet, err := e.lookup(val[i+1 : j])
+		if err != nil {
+			return "", err
+		}
+		if !isSet {
+			return "", fmt.Errorf("%s references undefined variable %s",
+				e.curKey(), val[i+1:j])
+		}
+		b.WriteString(sub)
+		i = j
+	}
+
+	return b.String(), nil
+}
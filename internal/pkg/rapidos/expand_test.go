@@ -0,0 +1,220 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestExpandConf(t *testing.T) {
+	os.Setenv("RAPIDOS_TEST_ENV", "fromenv")
+	defer os.Unsetenv("RAPIDOS_TEST_ENV")
+	os.Unsetenv("RAPIDOS_TEST_UNSET")
+
+	tests := []struct {
+		name string
+		in   map[string]string
+		want map[string]string
+	}{
+		{
+			name: "no vars",
+			in:   map[string]string{"A": "a", "B": ""},
+			want: map[string]string{"A": "a", "B": ""},
+		},
+		{
+			name: "braced and bare",
+			in:   map[string]string{"A": "a", "B": "${A}/b", "C": "$A-c"},
+			want: map[string]string{"A": "a", "B": "a/b", "C": "a-c"},
+		},
+		{
+			name: "chained",
+			in: map[string]string{
+				"KERNEL_INSTALL_MOD_PATH": "${KERNEL_SRC}/mods",
+				"KERNEL_SRC":              "${HOME_DIR}/linux",
+				"HOME_DIR":                "/home/me",
+			},
+			want: map[string]string{
+				"KERNEL_INSTALL_MOD_PATH": "/home/me/linux/mods",
+				"KERNEL_SRC":              "/home/me/linux",
+				"HOME_DIR":                "/home/me",
+			},
+		},
+		{
+			name: "default when unset or empty",
+			in: map[string]string{
+				"EMPTY": "",
+				"A":     "${RAPIDOS_TEST_UNSET:-x}",
+				"B":     "${EMPTY:-y}",
+				"C":     "${EMPTY:-$A/${RAPIDOS_TEST_UNSET:-z}}",
+			},
+			want: map[string]string{
+				"EMPTY": "",
+				"A":     "x",
+				"B":     "y",
+				"C":     "x/z",
+			},
+		},
+		{
+			name: "default not used when set",
+			in:   map[string]string{"A": "a", "B": "${A:-b}"},
+			want: map[string]string{"A": "a", "B": "a"},
+		},
+		{
+			name: "environment fallback",
+			in:   map[string]string{"A": "${RAPIDOS_TEST_ENV}/a"},
+			want: map[string]string{"A": "fromenv/a"},
+		},
+		{
+			name: "conf takes precedence over environment",
+			in: map[string]string{
+				"RAPIDOS_TEST_ENV": "fromconf",
+				"A":                "$RAPIDOS_TEST_ENV",
+			},
+			want: map[string]string{
+				"RAPIDOS_TEST_ENV": "fromconf",
+				"A":                "fromconf",
+			},
+		},
+		{
+			name: "escaped and literal dollar",
+			in: map[string]string{
+				"CIFS_PW": `pa\$\${word}$`,
+				"B":       "a $ b",
+			},
+			want: map[string]string{
+				"CIFS_PW": "pa$${word}$",
+				"B":       "a $ b",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		err := expandConf(tc.in, nil, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		for k, v := range tc.want {
+			if tc.in[k] != v {
+				t.Errorf("%s: %s=%q, want %q", tc.name, k, tc.in[k], v)
+			}
+		}
+	}
+}
+
+func TestExpandConfErrors(t *testing.T) {
+	os.Unsetenv("RAPIDOS_TEST_UNSET")
+
+	tests := []struct {
+		name    string
+		in      map[string]string
+		wantErr string
+	}{
+		{
+			name:    "self reference",
+			in:      map[string]string{"A": "${A}"},
+			wantErr: "cycle: A -> A",
+		},
+		{
+			name: "indirect cycle",
+			in: map[string]string{
+				"A": "${B}",
+				"B": "x${C}",
+				"C": "$A",
+			},
+			wantErr: "cycle: A -> B -> C -> A",
+		},
+		{
+			name:    "undefined",
+			in:      map[string]string{"A": "${RAPIDOS_TEST_UNSET}"},
+			wantErr: "A references undefined variable RAPIDOS_TEST_UNSET",
+		},
+		{
+			name:    "unterminated",
+			in:      map[string]string{"A": "${B"},
+			wantErr: "A: unterminated ${",
+		},
+		{
+			name:    "bad substitution",
+			in:      map[string]string{"A": "${1B}"},
+			wantErr: "A: bad substitution ${1B}",
+		},
+	}
+
+	for _, tc := range tests {
+		err := expandConf(tc.in, nil, nil)
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %q doesn't contain %q",
+				tc.name, err.Error(), tc.wantErr)
+		}
+	}
+}
+
+func TestParseConfExpand(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	confPath := path.Join(tmpDir, "rapidos.conf")
+	err = ioutil.WriteFile(confPath, []byte(`
+KERNEL_INSTALL_MOD_PATH="${KERNEL_SRC}/mods"
+KERNEL_SRC="/src/linux"
+NET_PREFIX="192.168.155"
+
+[vm.1]
+tap = "tap0"
+mac = "b8:ac:24:45:c5:01"
+ip = "${NET_PREFIX}.101"
+hostname = "rapido1"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overlay values are taken literally, including self references
+	overlay := map[string]string{"KERNEL_SRC": "/other/linux",
+		"CIFS_PW": "pa$$word", "DYN_DEBUG_MODULES": "$DYN_DEBUG_MODULES"}
+	conf, err := ParseConf(confPath, overlay, false)
+	if err != nil {
+		t.Fatalf("ParseConf failed: %v", err)
+	}
+
+	// overlay values should be propagated to referencing keys
+	if conf.f["KERNEL_INSTALL_MOD_PATH"] != "/other/linux/mods" {
+		t.Errorf("unexpected KERNEL_INSTALL_MOD_PATH: %s",
+			conf.f["KERNEL_INSTALL_MOD_PATH"])
+	}
+
+	if conf.f["CIFS_PW"] != "pa$$word" ||
+		conf.f["DYN_DEBUG_MODULES"] != "$DYN_DEBUG_MODULES" {
+		t.Errorf("overlay values expanded: %q, %q", conf.f["CIFS_PW"],
+			conf.f["DYN_DEBUG_MODULES"])
+	}
+
+	vmDef, err := conf.GetVMDef(1)
+	if err != nil {
+		t.Fatalf("GetVMDef failed: %v", err)
+	}
+	if vmDef.IPAddr != "192.168.155.101" {
+		t.Errorf("unexpected VM IP address: %s", vmDef.IPAddr)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// per-host seed for MAC address generation, so that VMs on different hosts
+// sharing a network are unlikely to collide
+func getMACSeed() string {
+	id, err := ioutil.ReadFile("/etc/machine-id")
+	if err == nil && len(strings.TrimSpace(string(id))) > 0 {
+		return strings.TrimSpace(string(id))
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// generate a locally administered unicast MAC address for VM @vmIndex. The
+// address is deterministic, so that DHCP static leases match it.
+func genMACAddr(seed string, vmIndex int, hostname string) string {
+	sum := sha256.Sum256([]byte(seed + "\n" + strconv.Itoa(vmIndex) +
+		"\n" + hostname))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac.String()
+}
+
+// return an error if @mac is already in use by a running VM under @pidsDir,
+// other than VM @vmIndex, as recorded in its VM info
+func checkMACUnused(pidsDir string, vmIndex int, mac string) error {
+	vms, err := ListVMs(pidsDir)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if vm.Index == vmIndex || !vm.Running {
+			continue
+		}
+		if strings.EqualFold(vm.MACAddr, mac) {
+			return fmt.Errorf("VM %d MAC address %s already used by "+
+				"running VM %d, set MAC_ADDR%d in rapidos.conf",
+				vmIndex, mac, vm.Index, vmIndex)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestGenMACAddr(t *testing.T) {
+	mac1 := genMACAddr("seed", 1, "rapido1")
+	hwaddr, err := net.ParseMAC(mac1)
+	if err != nil {
+		t.Fatalf("invalid MAC address %s: %v", mac1, err)
+	}
+	if hwaddr[0]&0x02 == 0 || hwaddr[0]&0x01 != 0 {
+		t.Errorf("%s not locally administered unicast", mac1)
+	}
+	if genMACAddr("seed", 1, "rapido1") != mac1 {
+		t.Errorf("MAC address generation not deterministic")
+	}
+	for _, other := range []string{genMACAddr("seed", 2, "rapido1"),
+		genMACAddr("other", 1, "rapido1"),
+		genMACAddr("seed", 1, "rapido2")} {
+		if other == mac1 {
+			t.Errorf("unexpected MAC address collision: %s", other)
+		}
+	}
+}
+
+func TestMACUnused(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	// VM 2, "running" as this test process, already uses mac
+	mac := genMACAddr("seed", 1, "rapido1")
+	vmPidPath := getPidPath(pidsDir, 2)
+	err = ioutil.WriteFile(vmPidPath, []byte(strconv.Itoa(os.Getpid())),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(getVMInfoPath(vmPidPath),
+		[]byte(`{"Index": 2, "MACAddr": "`+mac+`"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkMACUnused(pidsDir, 1, mac)
+	if err == nil {
+		t.Errorf("MAC address collision with VM 2 not detected")
+	}
+	err = checkMACUnused(pidsDir, 2, mac)
+	if err != nil {
+		t.Errorf("VM 2 collides with itself: %v", err)
+	}
+	err = checkMACUnused(pidsDir, 1, genMACAddr("seed", 1, "rapido2"))
+	if err != nil {
+		t.Errorf("unexpected collision: %v", err)
+	}
+}
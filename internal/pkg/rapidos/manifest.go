@@ -12,7 +12,9 @@
 package rapidos
 
 import (
+	"fmt"
 	"log"
+	"path"
 )
 
 type Inventory struct {
@@ -51,6 +53,19 @@ type Manifest struct {
 	// config.
 	InventoryCB func(RapidosConf, *Inventory) error
 
+	// rapidos.conf keys which must be set for this init to function.
+	// Only ConfRequired and ConfOptional keys (plus globals such as
+	// DYN_DEBUG_MODULES) are embedded in the image for the uinit.
+	ConfRequired []string
+	// rapidos.conf keys which this init makes use of if set
+	ConfOptional []string
+	// subset of ConfRequired and ConfOptional keys which (if set) must
+	// refer to an existing directory
+	ConfDirs []string
+	// embed the hostname and static addresses of each VM defined in
+	// rapidos.conf, e.g. for inits which form a cluster across VMs
+	ConfVMDefs bool
+
 	// VMResources are different from the rest of the Manifest in that they are
 	// considered at VM boot time.
 	VMResources Resources
@@ -60,6 +75,22 @@ var (
 	manifs = make(map[string]Manifest)
 )
 
+// initramfs directory which each u-root builder installs commands to
+var builderBinDirs = map[string]string{
+	"bb":     "/bbin",
+	"binary": "/bin",
+}
+
+// return the initramfs path of the run_shell default shell, which is built by
+// u-root @builder alongside the init's other commands
+func getDefaultShell(builder string) (string, error) {
+	binDir, ok := builderBinDirs[builder]
+	if !ok {
+		return "", fmt.Errorf("unsupported builder type %s", builder)
+	}
+	return path.Join(binDir, "run_shell"), nil
+}
+
 // XXX this is called by manifest init() functions, so should panic on error.
 func AddManifest(m Manifest) {
 	if len(m.Name) == 0 {
@@ -83,6 +114,11 @@ func AddManifest(m Manifest) {
 			name, m.VMResources.Memory, err)
 	}
 
+	err = m.VMResources.validateExtra()
+	if err != nil {
+		log.Fatalf("%s: invalid manifest resources: %v", name, err)
+	}
+
 	if _, ok := manifs[name]; ok {
 		log.Fatalf("%s: manifest already present", name)
 	}
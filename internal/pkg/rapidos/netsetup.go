@@ -0,0 +1,222 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"fmt"
+	"log"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/rtnl"
+)
+
+// return the tap devices for all VMs configured in rapidos.conf
+func (conf *RapidosConf) getTapDevs() ([]*RapidosConfVM, error) {
+	var vmDefs []*RapidosConfVM
+
+	nVMs := conf.NumVMDefs()
+	if nVMs == 0 {
+		return nil, fmt.Errorf("rapidos.conf lacks VM network config")
+	}
+	for vmIndex := 1; vmIndex <= nVMs; vmIndex++ {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			return nil, err
+		}
+		vmDefs = append(vmDefs, vmDef)
+	}
+	return vmDefs, nil
+}
+
+// NetSetup provisions the rapidos bridge and a tap device for each VM
+// configured in rapidos.conf. Everything provisioned is rolled back on failure.
+// Root (or CAP_NET_ADMIN) is required.
+func NetSetup(conf *RapidosConf) error {
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return err
+	}
+	if netMode != netModeBridge {
+		return fmt.Errorf("network setup not required for NET_MODE=%s",
+			netMode)
+	}
+
+	br, err := conf.GetBridgeConf()
+	if err != nil {
+		return err
+	}
+	vmDefs, err := conf.getTapDevs()
+	if err != nil {
+		return err
+	}
+
+	c, err := rtnl.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// cleanup on failure by calling whatever has been appended to @unwind
+	var unwind []func() error
+	defer func() {
+		for i := len(unwind) - 1; i >= 0; i-- {
+			uerr := unwind[i]()
+			if uerr != nil {
+				log.Printf("rollback failed: %v\n", uerr)
+			}
+		}
+	}()
+
+	err = c.BridgeAdd(br.BrDev)
+	if err != nil {
+		return fmt.Errorf("failed to create bridge %s: %v", br.BrDev, err)
+	}
+	unwind = append(unwind, func() error { return c.LinkDel(br.BrDev) })
+	fmt.Printf("+ created bridge %s", br.BrDev)
+
+	if br.BrAddr != nil {
+		err = c.AddrAdd(br.BrDev, br.BrAddr)
+		if err != nil {
+			fmt.Println()
+			return fmt.Errorf("failed to add %s to %s: %v",
+				br.BrAddr, br.BrDev, err)
+		}
+		unwind = append(unwind, func() error {
+			return c.AddrDel(br.BrDev, br.BrAddr)
+		})
+		fmt.Printf(" with address %s", br.BrAddr)
+	}
+
+	if br.BrAddr6 != nil {
+		err = c.AddrAdd(br.BrDev, br.BrAddr6)
+		if err != nil {
+			fmt.Println()
+			return fmt.Errorf("failed to add %s to %s: %v",
+				br.BrAddr6, br.BrDev, err)
+		}
+		unwind = append(unwind, func() error {
+			return c.AddrDel(br.BrDev, br.BrAddr6)
+		})
+		fmt.Printf(" with address %s", br.BrAddr6)
+	}
+
+	if br.BrIf != "" {
+		err = c.LinkSetMaster(br.BrIf, br.BrDev)
+		if err != nil {
+			fmt.Println()
+			return fmt.Errorf("failed to connect %s to %s: %v",
+				br.BrIf, br.BrDev, err)
+		}
+		unwind = append(unwind, func() error {
+			return c.LinkSetMaster(br.BrIf, "")
+		})
+		fmt.Printf(", connected to %s", br.BrIf)
+	}
+	fmt.Println()
+
+	for _, vmDef := range vmDefs {
+		tapDev := vmDef.TapDev
+		err = rtnl.TapAdd(tapDev, br.TapUID)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", tapDev, err)
+		}
+		unwind = append(unwind, func() error { return c.LinkDel(tapDev) })
+
+		err = c.LinkSetMaster(tapDev, br.BrDev)
+		if err != nil {
+			return fmt.Errorf("failed to connect %s to %s: %v",
+				tapDev, br.BrDev, err)
+		}
+		fmt.Printf("+ created %s\n", tapDev)
+	}
+
+	// devices are all removed on rollback, so no need to bring them down
+	err = c.LinkSetUp(br.BrDev, true)
+	if err != nil {
+		return err
+	}
+	for _, vmDef := range vmDefs {
+		err = c.LinkSetUp(vmDef.TapDev, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	// success! clear unwind
+	unwind = nil
+	return nil
+}
+
+// NetTeardown removes everything provisioned by NetSetup(), and stops any
+// DHCP server running for @pidsDir. Teardown continues past failures, with the
+// first error returned.
+func NetTeardown(conf *RapidosConf, pidsDir string) error {
+	var firstErr error
+	saveErr := func(err error) {
+		if err != nil {
+			log.Printf("%v\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	br, err := conf.GetBridgeConf()
+	if err != nil {
+		return err
+	}
+	vmDefs, err := conf.getTapDevs()
+	if err != nil {
+		return err
+	}
+
+	c, err := rtnl.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if conf.DHCPEnabled() {
+		err = StopDHCP(pidsDir)
+		if err != nil {
+			saveErr(fmt.Errorf("failed to stop DHCP server: %v", err))
+		}
+	}
+
+	for _, vmDef := range vmDefs {
+		err = c.LinkDel(vmDef.TapDev)
+		if err != nil {
+			saveErr(fmt.Errorf("failed to remove %s: %v",
+				vmDef.TapDev, err))
+			continue
+		}
+		fmt.Printf("- removed %s\n", vmDef.TapDev)
+	}
+
+	if br.BrIf != "" {
+		err = c.LinkSetMaster(br.BrIf, "")
+		if err != nil {
+			saveErr(fmt.Errorf("failed to disconnect %s: %v",
+				br.BrIf, err))
+		}
+	}
+
+	// any bridge address goes with the device
+	err = c.LinkDel(br.BrDev)
+	if err != nil {
+		saveErr(fmt.Errorf("failed to remove bridge %s: %v",
+			br.BrDev, err))
+	} else {
+		fmt.Printf("- removed bridge %s\n", br.BrDev)
+	}
+
+	return firstErr
+}
@@ -12,8 +12,11 @@
 package rapidos
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 	"syscall"
@@ -29,10 +32,46 @@ type Resources struct {
 	// This value is MiB by default, but can be specified with an explicit
 	// M or G suffix
 	Memory string
+	// Additional disks to attach to the VM, each backed by a sparse file
+	// which is (re)created alongside the image at boot time.
+	Disks []Disk
+	// QEMU -cpu model, e.g. "host" or "Skylake-Server". The architecture
+	// default is used when not set.
+	CPUModel string
+	// NUMA topology. When set, Memory is split across the nodes, and each
+	// vCPU should be assigned to a node.
+	NUMANodes []NUMANode
+	// Back guest memory with hugepages, from the hugetlbfs mount at
+	// rapidos.conf HUGEPAGES_PATH (default /dev/hugepages).
+	HugePages bool
+	// Supplementary QEMU arguments, e.g. {"-gdb", "tcp::1234"}. These
+	// precede rapidos.conf QEMU_EXTRA_ARGS.
+	QEMUArgs []string
+	// Supplementary kernel command line parameters, e.g. {"loglevel=8"}.
+	// These precede rapidos.conf KERNEL_EXTRA_ARGS.
+	KernelArgs []string
+	// Guest TCP ports to forward from the host with NET_MODE="user", e.g.
+	// {9000}. Ignored with bridged networking.
+	Ports []uint16
 }
 
-// XXX the awkward QEMU-param on-disk format is used to retain compatibility
-// with Rapido vm.sh. Transition to gob like (file?) encoding in future.
+type Disk struct {
+	// Size of the sparse backing file. MiB by default, but can be
+	// specified with an explicit M or G suffix.
+	Size string
+	// Bus type: "virtio" (default), "scsi" or "nvme"
+	Bus string
+}
+
+type NUMANode struct {
+	// vCPUs assigned to this node, in QEMU -numa cpus= format, e.g. "0-1"
+	CPUs string
+	// Memory assigned to this node, in Resources.Memory format
+	Memory string
+}
+
+// XXX the awkward QEMU-param legacy xattr format is used to retain
+// compatibility with Rapido vm.sh. Apply() also stores a structured record.
 func packMemCPU(CPUs uint8, Memory string) (string, error) {
 	if CPUs < 1 {
 		return "", fmt.Errorf("invalid CPUs count %d", CPUs)
@@ -45,22 +84,78 @@ func packMemCPU(CPUs uint8, Memory string) (string, error) {
 	return xattrVal, nil
 }
 
-// parse Number with M/m or G/g suffix
-func ValidateMemStr(mem string) error {
+// parse Number with M/m or G/g suffix, returning the value in MiB
+func memStrToMiB(mem string) (uint64, error) {
 	memSuffix := ""
 	trailerStripped := strings.TrimRight(mem, "MmGg")
 	if trailerStripped != mem {
 		memSuffix = strings.TrimPrefix(mem, trailerStripped)
 		if len(memSuffix) > 1 {
-			return fmt.Errorf("invalid mem resource suffix: %s\n",
+			return 0, fmt.Errorf("invalid mem resource suffix: %s\n",
 				memSuffix)
 		}
 	}
 
-	_, err := strconv.ParseUint(trailerStripped, 10, 64)
+	mib, err := strconv.ParseUint(trailerStripped, 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid mem resource: %v\n", err)
+		return 0, fmt.Errorf("invalid mem resource: %v\n", err)
+	}
+	if memSuffix == "G" || memSuffix == "g" {
+		mib *= 1024
+	}
+	return mib, nil
+}
+
+// parse Number with M/m or G/g suffix
+func ValidateMemStr(mem string) error {
+	_, err := memStrToMiB(mem)
+	return err
+}
+
+// check the Disks and NUMANodes resources. CPUs and Memory are checked
+// separately, as they're also needed for the legacy xattrs.
+func (resc *Resources) validateExtra() error {
+	for i, disk := range resc.Disks {
+		_, err := memStrToMiB(disk.Size)
+		if err != nil {
+			return fmt.Errorf("disk %d size: %v", i,
+				strings.TrimSpace(err.Error()))
+		}
+		switch disk.Bus {
+		case "", "virtio", "scsi", "nvme":
+		default:
+			return fmt.Errorf("disk %d: unsupported bus %s",
+				i, disk.Bus)
+		}
+	}
+
+	if len(resc.NUMANodes) == 0 {
+		return nil
+	}
+	if resc.Memory == "" {
+		return fmt.Errorf("NUMA nodes require a memory resource")
 	}
+	totalMiB, err := memStrToMiB(resc.Memory)
+	if err != nil {
+		return err
+	}
+	var nodesMiB uint64
+	for i, node := range resc.NUMANodes {
+		if node.CPUs == "" {
+			return fmt.Errorf("NUMA node %d lacks CPUs", i)
+		}
+		mib, err := memStrToMiB(node.Memory)
+		if err != nil {
+			return fmt.Errorf("NUMA node %d memory: %v", i,
+				strings.TrimSpace(err.Error()))
+		}
+		nodesMiB += mib
+	}
+	if nodesMiB != totalMiB {
+		return fmt.Errorf("NUMA node memory (%dM) doesn't match memory "+
+			"resource (%dM)", nodesMiB, totalMiB)
+	}
+
 	return nil
 }
 
@@ -81,7 +176,7 @@ func unpackMemCPU(xattrVal string) (uint8, string, error) {
 	}
 
 	if nCPUs < 1 || nCPUs > 255 {
-		return 0, "", fmt.Errorf("invalid CPU resource %u", nCPUs)
+		return 0, "", fmt.Errorf("invalid CPU resource %d", nCPUs)
 	}
 	err = ValidateMemStr(mem)
 	if err != nil {
@@ -91,10 +186,27 @@ func unpackMemCPU(xattrVal string) (uint8, string, error) {
 	return uint8(nCPUs), mem, nil
 }
 
-// store the Resources state as xattrs on @imgPath
+// On-disk Resources format, stored JSON encoded in the rscXattr xattr, or in a
+// sidecar file alongside the image if the filesystem lacks user xattr support.
+type rscRecord struct {
+	Version   int
+	Resources Resources
+}
+
+const (
+	rscVersion       = 1
+	rscXattr         = "user.rapidos.vm_resources"
+	rscSidecarSuffix = ".resources.json"
+)
+
+func rscSidecarPath(imgPath string) string {
+	return imgPath + rscSidecarSuffix
+}
+
+// store the legacy Resources state as xattrs on @imgPath
 // XXX intentionally use the "user.rapido." namespace, to remain compatible
 // with github.com/rapido-linux
-func (resc *Resources) Apply(imgPath string) error {
+func (resc *Resources) applyLegacy(imgPath string) error {
 	var err error
 
 	if !resc.Network {
@@ -122,19 +234,68 @@ func (resc *Resources) Apply(imgPath string) error {
 	return nil
 }
 
-// restore Resources state based on @imgPath xattrs
+// store the Resources state alongside @imgPath
+func (resc *Resources) Apply(imgPath string) error {
+	rec := rscRecord{Version: rscVersion, Resources: *resc}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Setxattr(imgPath, rscXattr, b, 0)
+	if err == syscall.ENOTSUP {
+		// tmpfs, NFS, etc. Legacy xattrs can't be stored either, so
+		// the image won't be bootable via rapido vm.sh.
+		log.Printf("%s lacks xattr support, using %s\n",
+			imgPath, rscSidecarPath(imgPath))
+		return ioutil.WriteFile(rscSidecarPath(imgPath), b, 0644)
+	} else if err != nil {
+		return err
+	}
+
+	// drop any stale sidecar from a previous cut
+	err = os.Remove(rscSidecarPath(imgPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return resc.applyLegacy(imgPath)
+}
+
+// return the JSON encoded resources record for @imgPath, or nil if none is
+// present.
+func readRscRecord(imgPath string) ([]byte, error) {
+	sz, err := syscall.Getxattr(imgPath, rscXattr, nil)
+	if err == nil {
+		b := make([]byte, sz)
+		sz, err = syscall.Getxattr(imgPath, rscXattr, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:sz], nil
+	} else if err != syscall.ENODATA && err != syscall.ENOTSUP {
+		log.Printf("getxattr failed: %v\n", err)
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(rscSidecarPath(imgPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// restore Resources state based on @imgPath legacy xattrs
 // XXX intentionally use the "user.rapido." namespace, to remain compatible
 // with github.com/rapido-linux
-func (resc *Resources) Retrieve(imgPath string) error {
+func (resc *Resources) retrieveLegacy(imgPath string) error {
 	b := make([]byte, 256)
 
-	// defaults to be kept if getxattr returns ENODATA (no xattr)
-	resc.Network = true
-	resc.CPUs = 2
-	resc.Memory = "512M"
-
 	sz, err := syscall.Getxattr(imgPath, "user.rapido.vm_networkless", b)
-	if err != nil && err != syscall.ENODATA {
+	if err != nil && err != syscall.ENODATA && err != syscall.ENOTSUP {
 		log.Printf("getxattr failed: %v\n", err)
 		return err
 	} else if err == nil {
@@ -147,7 +308,7 @@ func (resc *Resources) Retrieve(imgPath string) error {
 	}
 
 	sz, err = syscall.Getxattr(imgPath, "user.rapido.vm_resources", b)
-	if err != nil && err != syscall.ENODATA {
+	if err != nil && err != syscall.ENODATA && err != syscall.ENOTSUP {
 		log.Printf("getxattr failed: %v\n", err)
 		return err
 	} else if err == nil {
@@ -165,3 +326,33 @@ func (resc *Resources) Retrieve(imgPath string) error {
 
 	return nil
 }
+
+// restore Resources state for @imgPath. The structured record is preferred,
+// with the legacy xattrs used for images cut by older versions or by rapido.
+func (resc *Resources) Retrieve(imgPath string) error {
+	// defaults to be kept if no (or only a partial) record is found
+	resc.Network = true
+	resc.CPUs = 2
+	resc.Memory = "512M"
+
+	b, err := readRscRecord(imgPath)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return resc.retrieveLegacy(imgPath)
+	}
+
+	rec := rscRecord{Resources: *resc}
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		return fmt.Errorf("invalid resources record: %v", err)
+	}
+	if rec.Version < 1 || rec.Version > rscVersion {
+		return fmt.Errorf("unsupported resources version %d, re-cut %s",
+			rec.Version, imgPath)
+	}
+	*resc = rec.Resources
+
+	return nil
+}
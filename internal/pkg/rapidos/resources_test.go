@@ -0,0 +1,122 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestResourcesApplyRetrieve(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	imgPath := path.Join(tmpDir, "test.cpio")
+	err = ioutil.WriteFile(imgPath, []byte("img"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored as xattr or sidecar, depending on tmpDir xattr support
+	in := Resources{Network: false, CPUs: 4, Memory: "1G"}
+	err = in.Apply(imgPath)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	var out Resources
+	err = out.Retrieve(imgPath)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("retrieved %+v, want %+v", out, in)
+	}
+}
+
+func TestResourcesRetrieveSidecar(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	imgPath := path.Join(tmpDir, "test.cpio")
+	err = ioutil.WriteFile(imgPath, []byte("img"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// partial record: unset fields should retain defaults
+	err = ioutil.WriteFile(rscSidecarPath(imgPath),
+		[]byte(`{"Version":1,"Resources":{"CPUs":3}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out Resources
+	err = out.Retrieve(imgPath)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	want := Resources{Network: true, CPUs: 3, Memory: "512M"}
+	if !reflect.DeepEqual(want, out) {
+		t.Errorf("retrieved %+v, want %+v", out, want)
+	}
+
+	err = ioutil.WriteFile(rscSidecarPath(imgPath),
+		[]byte(`{"Version":99,"Resources":{}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = out.Retrieve(imgPath)
+	if err == nil {
+		t.Errorf("Retrieve succeeded with unsupported version")
+	}
+}
+
+func TestResourcesValidateExtra(t *testing.T) {
+	tests := []struct {
+		resc  Resources
+		valid bool
+	}{
+		{Resources{Disks: []Disk{{Size: "1G"}, {Size: "10", Bus: "nvme"}}},
+			true},
+		{Resources{Disks: []Disk{{Size: "1T"}}}, false},
+		{Resources{Disks: []Disk{{Size: "1G", Bus: "ide"}}}, false},
+		{Resources{Memory: "1G", NUMANodes: []NUMANode{
+			{CPUs: "0", Memory: "512M"},
+			{CPUs: "1", Memory: "512"}}},
+			true},
+		{Resources{Memory: "1G", NUMANodes: []NUMANode{
+			{CPUs: "0", Memory: "512M"}}},
+			false},
+		{Resources{Memory: "1G", NUMANodes: []NUMANode{
+			{Memory: "1G"}}},
+			false},
+	}
+
+	for _, tc := range tests {
+		err := tc.resc.validateExtra()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.resc, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%+v: expected error", tc.resc)
+		}
+	}
+}
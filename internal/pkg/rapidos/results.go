@@ -0,0 +1,221 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// virtio-serial port name, which must match uinit_common
+const resultsPortName = "org.rapidos.results"
+
+// result events reported by uinit_common.SendResult()
+const (
+	resultReady  = "ready"
+	resultFailed = "failed"
+	resultExit   = "exit"
+)
+
+// kernel parameter carrying the -run command, which must match uinit_common
+const runParam = "rapidos.run"
+
+// leave room for other kernel parameters within the x86 2048 byte limit
+const maxRunArgLen = 1024
+
+// VMResult is a structured event sent by a VM's uinit, via a virtio-serial
+// port which QEMU writes to a file alongside the pidfile.
+type VMResult struct {
+	Event   string          `json:"event"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+func getResultsPath(vmPidPath string) string {
+	return getVMStatePath(vmPidPath, ".results")
+}
+
+// remove stale results from any previous run, so that they aren't seen
+// before QEMU recreates the file
+func removeResults(vmPidPath string) error {
+	err := os.Remove(getResultsPath(vmPidPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// QEMU arguments for the guest to host results channel
+func getQEMUResultsArgs(vmPidPath string) []string {
+	return []string{"-device", "virtio-serial",
+		"-chardev", "file,id=results,path=" + getResultsPath(vmPidPath),
+		"-device", "virtserialport,chardev=results,name=" +
+			resultsPortName}
+}
+
+func parseResult(line string) (*VMResult, error) {
+	var r VMResult
+	err := json.Unmarshal([]byte(line), &r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VM result %q: %v", line, err)
+	}
+	return &r, nil
+}
+
+// ReadVMResults returns all results reported so far by VM @vmIndex
+func ReadVMResults(pidsDir string, vmIndex int) ([]VMResult, error) {
+	var results []VMResult
+
+	f, err := os.Open(getResultsPath(getPidPath(pidsDir, vmIndex)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		r, err := parseResult(line)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *r)
+	}
+	return results, scanner.Err()
+}
+
+// return true if @results includes a ready event
+func resultsReady(results []VMResult) bool {
+	for _, r := range results {
+		if r.Event == resultReady {
+			return true
+		}
+	}
+	return false
+}
+
+// return the kernel parameter used to pass @runCmd to the VM. The command is
+// base64 encoded to avoid any kernel command line quoting issues.
+func getRunKernArg(runCmd string) (string, error) {
+	if strings.TrimSpace(runCmd) == "" {
+		return "", fmt.Errorf("empty run command")
+	}
+	arg := runParam + "=" +
+		base64.RawURLEncoding.EncodeToString([]byte(runCmd))
+	if len(arg) > maxRunArgLen {
+		return "", fmt.Errorf("run command too long for kernel cmdline")
+	}
+	return arg, nil
+}
+
+// return the exit status of the -run command reported in @results
+func resultsRunStatus(vmIndex int, results []VMResult) (int, error) {
+	err := resultsFailure(vmIndex, results)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range results {
+		if r.Event != resultExit {
+			continue
+		}
+		var st struct {
+			Status int `json:"status"`
+		}
+		err = json.Unmarshal(r.Data, &st)
+		if err != nil {
+			return 0, fmt.Errorf("invalid VM %d run status: %v",
+				vmIndex, err)
+		}
+		return st.Status, nil
+	}
+	return 0, fmt.Errorf("VM %d exited without reporting run status",
+		vmIndex)
+}
+
+// return the first failure in @results, or nil if none was reported
+func resultsFailure(vmIndex int, results []VMResult) error {
+	for _, r := range results {
+		if r.Event == resultFailed {
+			return fmt.Errorf("VM %d reported failure: %s", vmIndex,
+				r.Message)
+		}
+	}
+	return nil
+}
+
+// follow the results file at @resultsPath, calling @cb for each result
+// until @done is closed and any remaining results have been read. The file
+// may not exist until QEMU has started.
+func followResults(resultsPath string, done <-chan struct{},
+	cb func(VMResult)) {
+	var f *os.File
+	var rd *bufio.Reader
+	var partial string
+
+	for {
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		if f == nil {
+			var err error
+			f, err = os.Open(resultsPath)
+			if err == nil {
+				defer f.Close()
+				rd = bufio.NewReader(f)
+			}
+		}
+		for rd != nil {
+			line, err := rd.ReadString('\n')
+			partial += line
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("failed to read VM results: %v\n", err)
+				return
+			}
+			if strings.TrimSpace(partial) != "" {
+				r, err := parseResult(partial)
+				if err != nil {
+					log.Printf("%v\n", err)
+				} else {
+					cb(*r)
+				}
+			}
+			partial = ""
+		}
+
+		if finished {
+			return
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Duration(100 * time.Millisecond)):
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadVMResults(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	results, err := ReadVMResults(pidsDir, 1)
+	if err != nil || results != nil {
+		t.Fatalf("unexpected results without file: %v, %v", results, err)
+	}
+
+	resultsPath := getResultsPath(getPidPath(pidsDir, 1))
+	err = ioutil.WriteFile(resultsPath, []byte(
+		`{"event":"ready","message":"up","data":["iqn"],`+
+			`"time":"2019-06-01T10:00:00Z"}`+"\n\n"+
+			`{"event":"failed","message":"mount: EIO",`+
+			`"time":"2019-06-01T10:00:01Z"}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = ReadVMResults(pidsDir, 1)
+	if err != nil {
+		t.Fatalf("ReadVMResults failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Event != resultReady ||
+		string(results[0].Data) != `["iqn"]` ||
+		results[1].Message != "mount: EIO" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if !resultsReady(results) {
+		t.Errorf("ready result not found")
+	}
+	err = resultsFailure(1, results)
+	if err == nil || !strings.Contains(err.Error(), "mount: EIO") {
+		t.Errorf("unexpected failure: %v", err)
+	}
+}
+
+func TestFollowResults(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+	resultsPath := getResultsPath(getPidPath(pidsDir, 1))
+
+	var events []string
+	done := make(chan struct{})
+	followed := make(chan struct{})
+	go func() {
+		followResults(resultsPath, done, func(r VMResult) {
+			events = append(events, r.Event)
+		})
+		close(followed)
+	}()
+
+	// file is created after following starts, and written in pieces
+	time.Sleep(time.Duration(150 * time.Millisecond))
+	f, err := os.Create(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(`{"event":"output","mess`)
+	time.Sleep(time.Duration(150 * time.Millisecond))
+	f.WriteString(`age":"partial"}` + "\n" + `{"event":"ready"}` + "\n")
+	close(done)
+	<-followed
+
+	if len(events) != 2 || events[0] != "output" || events[1] != "ready" {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	arg, err := getRunKernArg("xfstests -g 'quick' && echo \"done\"")
+	if err != nil || strings.ContainsAny(arg, " '\"") {
+		t.Errorf("unexpected run kernel arg %q: %v", arg, err)
+	}
+	_, err = getRunKernArg(strings.Repeat("x", maxRunArgLen))
+	if err == nil {
+		t.Errorf("expected error for long run command")
+	}
+
+	status, err := resultsRunStatus(1, []VMResult{
+		{Event: resultReady},
+		{Event: resultExit, Data: []byte(`{"status":3}`)},
+	})
+	if err != nil || status != 3 {
+		t.Errorf("unexpected run status %d: %v", status, err)
+	}
+	_, err = resultsRunStatus(1, []VMResult{{Event: resultReady}})
+	if err == nil {
+		t.Errorf("expected error without exit result")
+	}
+	_, err = resultsRunStatus(1, []VMResult{{Event: resultFailed}})
+	if err == nil || !strings.Contains(err.Error(), "failure") {
+		t.Errorf("unexpected error for failed result: %v", err)
+	}
+}
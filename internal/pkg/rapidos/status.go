@@ -0,0 +1,287 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/qmp"
+)
+
+// VMInfo describes a VM started via Boot(). It is stored alongside the QEMU
+// pidfile.
+type VMInfo struct {
+	Index    int
+	Image    string
+	MACAddr  string
+	IPAddr   string
+	IP6Addr  string `json:",omitempty"`
+	Hostname string
+	Started  time.Time
+
+	// The following are determined by ListVMs() rather than stored
+	Pid     int  `json:"-"`
+	Running bool `json:"-"`
+}
+
+func getVMInfoPath(vmPidPath string) string {
+	return getVMStatePath(vmPidPath, ".json")
+}
+
+func writeVMInfo(conf *RapidosConf, imgPath string, resc Resources,
+	vmPidPath string, vmIndex int) error {
+	info := VMInfo{Index: vmIndex, Image: imgPath, Started: time.Now()}
+
+	absImg, err := filepath.Abs(imgPath)
+	if err == nil {
+		info.Image = absImg
+	}
+
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return err
+	}
+	if resc.Network && netMode == netModeBridge {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			return err
+		}
+		// generated MAC addresses are unlikely, but not certain, to be
+		// unique
+		err = checkMACUnused(filepath.Dir(vmPidPath), vmIndex,
+			vmDef.MACAddr)
+		if err != nil {
+			return err
+		}
+		info.MACAddr = vmDef.MACAddr
+		info.IPAddr = vmDef.IPAddr
+		info.IP6Addr = vmDef.IP6Addr
+		info.Hostname = vmDef.Hostname
+	}
+
+	b, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getVMInfoPath(vmPidPath), b, 0644)
+}
+
+// VMs booted via rapido vm.sh only have a pidfile, in which case the pidfile
+// mtime is used as the start time.
+func readVMInfo(vmPidPath string, vmIndex int) (*VMInfo, error) {
+	info := VMInfo{Index: vmIndex}
+
+	b, err := ioutil.ReadFile(getVMInfoPath(vmPidPath))
+	if err == nil {
+		err = json.Unmarshal(b, &info)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VM %d info: %v",
+				vmIndex, err)
+		}
+	} else if os.IsNotExist(err) {
+		stat, err := os.Stat(vmPidPath)
+		if err != nil {
+			return nil, err
+		}
+		info.Started = stat.ModTime()
+	} else {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// ListVMs returns details of each VM with a pidfile under @pidsDir, sorted by
+// index. VMs which are no longer running are included, with Running=false.
+func ListVMs(pidsDir string) ([]VMInfo, error) {
+	var vms []VMInfo
+
+	pidPaths, err := filepath.Glob(path.Join(pidsDir, "rapido_vm*.pid"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmPidPath := range pidPaths {
+		var vmIndex int
+		_, err := fmt.Sscanf(path.Base(vmPidPath), "rapido_vm%d.pid",
+			&vmIndex)
+		if err != nil || vmPidPath != getPidPath(pidsDir, vmIndex) {
+			continue // not one of ours
+		}
+
+		info, err := readVMInfo(vmPidPath, vmIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		// garbage in the pidfile is treated as not running
+		info.Pid, err = readQEMUPid(vmPidPath)
+		if err == nil && info.Pid != 0 {
+			info.Running = isProcRunning(info.Pid)
+		}
+		vms = append(vms, *info)
+	}
+
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].Index < vms[j].Index
+	})
+	return vms, nil
+}
+
+func removeVMState(vmPidPath string) error {
+	for _, p := range []string{vmPidPath, getVMInfoPath(vmPidPath),
+		getQMPPath(vmPidPath), getQMPEventsPath(vmPidPath),
+		getResultsPath(vmPidPath)} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanStaleVMs removes the pidfile and associated state for any VMs under
+// @pidsDir which are no longer running. The cleaned VM indices are returned.
+func CleanStaleVMs(pidsDir string) ([]int, error) {
+	var cleaned []int
+
+	vms, err := ListVMs(pidsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vm := range vms {
+		if vm.Running {
+			continue
+		}
+		err = removeVMState(getPidPath(pidsDir, vm.Index))
+		if err != nil {
+			return cleaned, err
+		}
+		cleaned = append(cleaned, vm.Index)
+	}
+
+	return cleaned, nil
+}
+
+// DialQMP connects to the QMP control socket of running VM @vmIndex
+func DialQMP(pidsDir string, vmIndex int,
+	timeout time.Duration) (*qmp.Client, error) {
+	vmPidPath := getPidPath(pidsDir, vmIndex)
+	isRunning, err := checkQEMUProc(vmPidPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isRunning {
+		return nil, fmt.Errorf("VM %d is not running", vmIndex)
+	}
+	return qmp.Dial(getQMPPath(vmPidPath), timeout)
+}
+
+func qmpPowerdown(sockPath string, timeout time.Duration) error {
+	c, err := qmp.Dial(sockPath, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.SystemPowerdown()
+}
+
+func waitProcExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !isProcRunning(pid) {
+			return true
+		}
+		time.Sleep(time.Duration(100 * time.Millisecond))
+	}
+	return !isProcRunning(pid)
+}
+
+// DefaultStopTimeout is how long StopVM() waits for a graceful powerdown. u-root
+// guests generally don't handle ACPI powerdown, so it's kept short.
+const DefaultStopTimeout = time.Duration(5 * time.Second)
+
+// StopVM shuts down VM @vmIndex, first by requesting a graceful (ACPI)
+// powerdown via QMP. If the VM is still running after @timeout, then QEMU is
+// sent SIGTERM, followed by SIGKILL.
+func StopVM(pidsDir string, vmIndex int, timeout time.Duration) error {
+	vmPidPath := getPidPath(pidsDir, vmIndex)
+	pid, err := readQEMUPid(vmPidPath)
+	if err != nil {
+		return err
+	}
+	if pid == 0 || !isProcRunning(pid) {
+		removeVMState(vmPidPath)
+		return fmt.Errorf("VM %d is not running", vmIndex)
+	}
+	if !isVMProc(pid, vmPidPath) {
+		// don't signal whichever process now has the pid
+		removeVMState(vmPidPath)
+		return fmt.Errorf("VM %d is not running, pid %d reused by "+
+			"another process", vmIndex, pid)
+	}
+
+	err = qmpPowerdown(getQMPPath(vmPidPath), timeout)
+	if err != nil {
+		log.Printf("VM %d QMP powerdown failed: %v\n", vmIndex, err)
+	} else if waitProcExit(pid, timeout) {
+		return removeVMState(vmPidPath)
+	} else {
+		log.Printf("VM %d powerdown timeout\n", vmIndex)
+	}
+
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		err = syscall.Kill(pid, sig)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+		if waitProcExit(pid, time.Duration(5*time.Second)) {
+			return removeVMState(vmPidPath)
+		}
+	}
+
+	return fmt.Errorf("VM %d (pid %d) failed to exit", vmIndex, pid)
+}
+
+// StopVMs shuts down all VMs in @vmIndices concurrently via StopVM(). The first
+// error is returned once all VMs have been handled.
+func StopVMs(pidsDir string, vmIndices []int, timeout time.Duration) error {
+	var wg sync.WaitGroup
+
+	errs := make([]error, len(vmIndices))
+	for i, vmIndex := range vmIndices {
+		wg.Add(1)
+		go func(i int, vmIndex int) {
+			defer wg.Done()
+			errs[i] = StopVM(pidsDir, vmIndex, timeout)
+		}(i, vmIndex)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
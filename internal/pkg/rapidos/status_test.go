@@ -0,0 +1,187 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListAndCleanVMs(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	// VM 1 "running" as this test process, VM 2 stale
+	pids := map[int]string{
+		1: strconv.Itoa(os.Getpid()),
+		2: "2147483647",
+	}
+	for vmIndex, pid := range pids {
+		err = ioutil.WriteFile(getPidPath(pidsDir, vmIndex),
+			[]byte(pid+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(getVMInfoPath(getPidPath(pidsDir, 1)),
+		[]byte(`{"Index": 1, "Image": "/imgs/test.cpio"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// should be ignored
+	err = ioutil.WriteFile(path.Join(pidsDir, "rapido_vmX.pid"),
+		[]byte("1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vms, err := ListVMs(pidsDir)
+	if err != nil {
+		t.Fatalf("ListVMs failed: %v", err)
+	}
+	if len(vms) != 2 {
+		t.Fatalf("unexpected VM count: %+v", vms)
+	}
+	if vms[0].Index != 1 || !vms[0].Running ||
+		vms[0].Image != "/imgs/test.cpio" {
+		t.Errorf("unexpected VM 1 state: %+v", vms[0])
+	}
+	if vms[1].Index != 2 || vms[1].Running {
+		t.Errorf("unexpected VM 2 state: %+v", vms[1])
+	}
+
+	cleaned, err := CleanStaleVMs(pidsDir)
+	if err != nil {
+		t.Fatalf("CleanStaleVMs failed: %v", err)
+	}
+	if len(cleaned) != 1 || cleaned[0] != 2 {
+		t.Errorf("unexpected cleaned VMs: %v", cleaned)
+	}
+	_, err = os.Stat(getPidPath(pidsDir, 2))
+	if !os.IsNotExist(err) {
+		t.Errorf("stale pidfile not removed: %v", err)
+	}
+	_, err = os.Stat(getPidPath(pidsDir, 1))
+	if err != nil {
+		t.Errorf("running VM pidfile removed: %v", err)
+	}
+}
+
+// accept QMP connections on @sockPath, acknowledging all commands without the
+// guest ever powering down
+func serveIgnoredQMP(t *testing.T, sockPath string) net.Listener {
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.Write([]byte(`{"QMP": {}}` + "\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					conn.Write([]byte(`{"return": {}}` + "\n"))
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestStopVMs(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	vmIndices := []int{1, 2, 3}
+	for _, vmIndex := range vmIndices {
+		vmPidPath := getPidPath(pidsDir, vmIndex)
+		// stand-in for QEMU, with the -pidfile argument checked by
+		// StopVM()
+		cmd := exec.Command("sh", "-c", "while :; do sleep 0.1; done",
+			"-pidfile", vmPidPath)
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reap on kill
+		go cmd.Wait()
+		defer cmd.Process.Kill()
+		err = ioutil.WriteFile(vmPidPath,
+			[]byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := serveIgnoredQMP(t, getQMPPath(vmPidPath))
+		defer ln.Close()
+	}
+
+	// powerdown timeouts should overlap, rather than accumulate
+	timeout := time.Duration(time.Second)
+	start := time.Now()
+	err = StopVMs(pidsDir, vmIndices, timeout)
+	if err != nil {
+		t.Fatalf("StopVMs failed: %v", err)
+	}
+	if time.Since(start) > timeout*time.Duration(len(vmIndices)) {
+		t.Errorf("VMs not stopped concurrently: took %v",
+			time.Since(start))
+	}
+	for _, vmIndex := range vmIndices {
+		_, err = os.Stat(getPidPath(pidsDir, vmIndex))
+		if !os.IsNotExist(err) {
+			t.Errorf("VM %d pidfile not removed: %v", vmIndex, err)
+		}
+	}
+}
+
+func TestStopVMReusedPid(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	// stale pidfile, with the pid reused by this test process
+	vmPidPath := getPidPath(pidsDir, 1)
+	err = ioutil.WriteFile(vmPidPath, []byte(strconv.Itoa(os.Getpid())),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = StopVM(pidsDir, 1, time.Duration(time.Second))
+	if err == nil {
+		t.Errorf("StopVM succeeded for reused pid")
+	}
+	_, err = os.Stat(vmPidPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("stale pidfile not removed: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"fmt"
+	"strings"
+)
+
+func validateKernel(conf *RapidosConf, m *Manifest) []error {
+	var errs []error
+
+	for _, key := range []string{"KERNEL_SRC", "KERNEL_INSTALL_MOD_PATH"} {
+		if conf.f[key] == "" {
+			continue
+		}
+		_, err := checkDirVal(conf.f, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		// kernel image and module checks would only repeat the above
+		return errs
+	}
+
+	_, err := conf.GetArch()
+	if err != nil {
+		// kernel image path is arch specific
+		return append(errs, err)
+	}
+
+	_, err = conf.GetKernImgPath()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("kernel image: %v", err))
+	}
+
+	if m != nil && len(m.Inventory.Kmods) > 0 {
+		_, err = conf.GetKmodsInfo()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("kernel modules: %v", err))
+		}
+	}
+
+	return errs
+}
+
+func validateVMDefs(conf *RapidosConf) []error {
+	var errs []error
+
+	nVMs := conf.NumVMDefs()
+	if nVMs == 0 {
+		return []error{fmt.Errorf("network required, but rapidos.conf " +
+			"lacks VM network config")}
+	}
+
+	macs := make(map[string]int)
+	for vmIndex := 1; vmIndex <= nVMs; vmIndex++ {
+		vmDef, err := conf.GetVMDef(vmIndex)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("VM %d: %s", vmIndex,
+				strings.TrimSpace(err.Error())))
+			continue
+		}
+		mac := strings.ToLower(vmDef.MACAddr)
+		if other, ok := macs[mac]; ok {
+			errs = append(errs, fmt.Errorf("VM %d: MAC address %s "+
+				"already used by VM %d", vmIndex, mac, other))
+		}
+		macs[mac] = vmIndex
+	}
+
+	return errs
+}
+
+func validateManifest(conf *RapidosConf, m *Manifest) []error {
+	var errs []error
+
+	for _, key := range m.ConfRequired {
+		if conf.f[key] == "" {
+			errs = append(errs, fmt.Errorf("%s: %s required but not "+
+				"configured", m.Name, key))
+		}
+	}
+
+	for _, key := range m.ConfDirs {
+		if conf.f[key] == "" {
+			continue // covered by ConfRequired if needed
+		}
+		_, err := checkDirVal(conf.f, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %v",
+				m.Name, key, err))
+		}
+	}
+
+	err := ValidateMemStr(m.VMResources.Memory)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s: memory resource: %s", m.Name,
+			strings.TrimSpace(err.Error())))
+	}
+
+	return errs
+}
+
+// ValidateConf checks @conf for any problems which would otherwise only be
+// found while cutting or booting an image for manifest @m. All problems are
+// returned, rather than only the first. If @m is nil then only manifest
+// independent parameters are checked.
+func ValidateConf(conf *RapidosConf, m *Manifest) []error {
+	errs := validateKernel(conf, m)
+
+	_, err := conf.GetNameservers()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// parsed by the uinit, so only validated here
+	_, err = conf.getBool("UINIT_FAIL_POWEROFF")
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	_, err = conf.GetBootTimeout()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = conf.GetRunTimeout()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = conf.GetWatchdog()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = conf.GetFailOnSplat()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if m == nil {
+		if conf.NumVMDefs() > 0 {
+			errs = append(errs, validateVMDefs(conf)...)
+		}
+		return errs
+	}
+
+	errs = append(errs, validateManifest(conf, m)...)
+
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return append(errs, err)
+	}
+	if m.VMResources.Network && netMode == netModeBridge {
+		errs = append(errs, validateVMDefs(conf)...)
+	}
+
+	return errs
+}
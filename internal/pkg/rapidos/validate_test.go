@@ -0,0 +1,124 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// create a minimal x86_64 kernel build tree at @kernelSrc
+func writeKernelSrc(t *testing.T, kernelSrc string) {
+	err := ioutil.WriteFile(path.Join(kernelSrc, ".config"),
+		[]byte("CONFIG_X86_64=y\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootDir := path.Join(kernelSrc, "arch/x86/boot")
+	err = os.MkdirAll(bootDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(bootDir, "bzImage"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConf(t *testing.T) {
+	kernelSrc, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(kernelSrc)
+	writeKernelSrc(t, kernelSrc)
+
+	m := &Manifest{
+		Name:         "test",
+		ConfRequired: []string{"TEST_REQUIRED"},
+		VMResources:  Resources{Network: true, Memory: "512M"},
+	}
+
+	tests := []struct {
+		name string
+		// merged into a minimal valid config
+		conf map[string]string
+		// substrings of each expected error, in order
+		wantErrs []string
+	}{
+		{
+			name: "valid minimal",
+		},
+		{
+			// rapidos.conf is shared by all images, so keys
+			// unknown to @m are ignored rather than reported
+			name: "unknown keys",
+			conf: map[string]string{"NOT_A_RAPIDOS_KEY": "1",
+				"CEPH_CONF": "/nonexistent"},
+		},
+		{
+			name:     "bad NET_MODE",
+			conf:     map[string]string{"NET_MODE": "vde"},
+			wantErrs: []string{"invalid NET_MODE: vde"},
+		},
+		{
+			name:     "bad BOOT_TIMEOUT",
+			conf:     map[string]string{"BOOT_TIMEOUT": "soon"},
+			wantErrs: []string{"invalid BOOT_TIMEOUT: soon"},
+		},
+		{
+			name:     "negative RUN_TIMEOUT",
+			conf:     map[string]string{"RUN_TIMEOUT": "-1m"},
+			wantErrs: []string{"invalid RUN_TIMEOUT: -1m"},
+		},
+		{
+			name: "all problems reported",
+			conf: map[string]string{"BOOT_TIMEOUT": "10",
+				"RUN_TIMEOUT": "bogus", "TEST_REQUIRED": ""},
+			wantErrs: []string{"invalid BOOT_TIMEOUT: 10",
+				"invalid RUN_TIMEOUT: bogus",
+				"test: TEST_REQUIRED required but not configured"},
+		},
+		{
+			name:     "bridge without VM definitions",
+			conf:     map[string]string{"NET_MODE": "bridge"},
+			wantErrs: []string{"lacks VM network config"},
+		},
+	}
+
+	for _, tc := range tests {
+		conf := &RapidosConf{f: map[string]string{
+			"KERNEL_SRC":    kernelSrc,
+			"NET_MODE":      "user",
+			"TEST_REQUIRED": "1",
+		}}
+		for key, val := range tc.conf {
+			conf.f[key] = val
+		}
+
+		errs := ValidateConf(conf, m)
+		if len(errs) != len(tc.wantErrs) {
+			t.Errorf("%s: got errors %v, want %d", tc.name, errs,
+				len(tc.wantErrs))
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), tc.wantErrs[i]) {
+				t.Errorf("%s: got error %q, want %q", tc.name,
+					err.Error(), tc.wantErrs[i])
+			}
+		}
+	}
+}
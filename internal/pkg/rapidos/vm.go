@@ -13,15 +13,33 @@ package rapidos
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/qmp"
 )
 
+// how long a timed out QEMU is given to exit after SIGTERM, before SIGKILL.
+// QEMU restores the terminal settings on SIGTERM, which -nographic leaves raw.
+const qemuTermGrace = time.Duration(5 * time.Second)
+
+// QEMU exit status following uinit failure with UINIT_FAIL_POWEROFF="1", via
+// the architecture exitDev. Must match uinit_common.FailExitCode.
+const uinitFailExitCode = 33
+
 func getPidPath(pidsDir string, vmIndex int) string {
 	// XXX use github.com/rapido-linux compatible pidfile for now, so that
 	// images can be booted by vm.sh alongside rapidos -boot.
@@ -29,14 +47,31 @@ func getPidPath(pidsDir string, vmIndex int) string {
 	return path.Join(pidsDir, file)
 }
 
-// qemu may put garbage in its pidfile, so read the first line only
-func checkQEMUProc(vmPidPath string) (bool, error) {
+// other per-VM state files are kept alongside the pidfile, with a different
+// suffix
+func getVMStatePath(vmPidPath string, suffix string) string {
+	return strings.TrimSuffix(vmPidPath, ".pid") + suffix
+}
+
+func getQMPPath(vmPidPath string) string {
+	return getVMStatePath(vmPidPath, ".qmp")
+}
+
+// QEMU only serves one client per monitor, so foreground VMs have a second
+// monitor for following events, leaving the QMP socket free for -stop and -qmp
+func getQMPEventsPath(vmPidPath string) string {
+	return getVMStatePath(vmPidPath, ".qmpev")
+}
+
+// qemu may put garbage in its pidfile, so read the first line only.
+// Returns a zero pid if the pidfile doesn't exist.
+func readQEMUPid(vmPidPath string) (int, error) {
 	file, err := os.Open(vmPidPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false, nil // not running - no pid file
+			return 0, nil // not running - no pid file
 		}
-		return false, err
+		return 0, err
 	}
 	defer file.Close()
 
@@ -44,27 +79,263 @@ func checkQEMUProc(vmPidPath string) (bool, error) {
 	pidB, isPrefix, err := reader.ReadLine()
 	if err != nil || isPrefix {
 		err = fmt.Errorf("pidfile read error or overflow")
-		return false, err
+		return 0, err
 	}
 
 	pidStr := strings.TrimSpace(string(pidB))
-	pid, err := strconv.Atoi(pidStr)
-	if err != nil {
-		return false, err
-	}
+	return strconv.Atoi(pidStr)
+}
 
+func isProcRunning(pid int) bool {
 	proc, err := os.FindProcess(pid)
 	if err != nil {
-		return false, err
+		return false
 	}
 
 	err = proc.Signal(syscall.Signal(0))
 	if err != nil {
 		// assume ESRCH or "os: process already finished"
-		return false, nil // not running
+		return false // not running
+	}
+
+	return true // running - kill(0) succeeds
+}
+
+// check that @pid is the QEMU process for the VM at @vmPidPath, rather than an
+// unrelated process which has reused the pid of a stale pidfile
+func isVMProc(pid int, vmPidPath string) bool {
+	cmdline, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) +
+		"/cmdline")
+	if err != nil {
+		return false
+	}
+	absPidPath, _ := filepath.Abs(vmPidPath)
+	args := strings.Split(string(cmdline), "\x00")
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] != "-pidfile" {
+			continue
+		}
+		p := filepath.Clean(args[i+1])
+		if p == filepath.Clean(vmPidPath) || p == absPidPath {
+			return true
+		}
+	}
+	return false
+}
+
+func checkQEMUProc(vmPidPath string) (bool, error) {
+	pid, err := readQEMUPid(vmPidPath)
+	if err != nil || pid == 0 {
+		return false, err
+	}
+
+	return isProcRunning(pid), nil
+}
+
+// return NUMA and hugepage memory backend arguments
+func getQEMUMemArgs(conf *RapidosConf, vmResources Resources) ([]string,
+	error) {
+	var rsc []string
+
+	hugePath := conf.f["HUGEPAGES_PATH"]
+	if hugePath == "" {
+		hugePath = "/dev/hugepages"
+	}
+
+	if len(vmResources.NUMANodes) == 0 {
+		if vmResources.HugePages {
+			rsc = append(rsc, "-mem-path", hugePath, "-mem-prealloc")
+		}
+		return rsc, nil
+	}
+
+	for i, node := range vmResources.NUMANodes {
+		// backend size defaults to bytes, so provide an explicit suffix
+		mib, err := memStrToMiB(node.Memory)
+		if err != nil {
+			return nil, err
+		}
+		memID := "mem" + strconv.Itoa(i)
+		backend := fmt.Sprintf("memory-backend-ram,id=%s,size=%dM",
+			memID, mib)
+		if vmResources.HugePages {
+			backend = fmt.Sprintf("memory-backend-file,id=%s,size=%dM,"+
+				"mem-path=%s,prealloc=on", memID, mib, hugePath)
+		}
+		rsc = append(rsc, "-object", backend, "-numa",
+			fmt.Sprintf("node,nodeid=%d,cpus=%s,memdev=%s",
+				i, node.CPUs, memID))
+	}
+
+	return rsc, nil
+}
+
+// (re)create sparse disk backing files under @diskDir and return the
+// corresponding QEMU arguments
+func getQEMUDiskArgs(vmResources Resources, diskDir string,
+	vmIndex int) ([]string, error) {
+	var rsc []string
+	haveSCSI := false
+
+	for i, disk := range vmResources.Disks {
+		mib, err := memStrToMiB(disk.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		diskPath := path.Join(diskDir,
+			fmt.Sprintf("rapido_vm%d_disk%d.img", vmIndex, i))
+		f, err := os.OpenFile(diskPath,
+			os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Truncate(int64(mib) << 20)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		diskID := "disk" + strconv.Itoa(i)
+		rsc = append(rsc, "-drive",
+			"file="+diskPath+",format=raw,if=none,id="+diskID)
+		switch disk.Bus {
+		case "", "virtio":
+			rsc = append(rsc, "-device", "virtio-blk-pci,drive="+diskID)
+		case "scsi":
+			if !haveSCSI {
+				rsc = append(rsc, "-device",
+					"virtio-scsi-pci,id=scsi0")
+				haveSCSI = true
+			}
+			rsc = append(rsc, "-device",
+				"scsi-hd,bus=scsi0.0,drive="+diskID)
+		case "nvme":
+			rsc = append(rsc, "-device",
+				"nvme,serial=rapidos"+strconv.Itoa(i)+
+					",drive="+diskID)
+		default:
+			return nil, fmt.Errorf("unsupported disk bus %s",
+				disk.Bus)
+		}
 	}
 
-	return true, nil // running - kill(0) succeeds
+	return rsc, nil
+}
+
+// return the host port used to forward @guestPort for VM @vmIndex. Each VM's
+// forwarded ports are offset by 100, so that VMs booted from the same image
+// don't collide.
+func getUserNetHostPort(conf *RapidosConf, guestPort uint16,
+	vmIndex int) (int, error) {
+	off, err := conf.getUserNetPortOffset()
+	if err != nil {
+		return 0, err
+	}
+	hostPort := int(guestPort) + off + (vmIndex-1)*100
+	if hostPort > 65535 {
+		return 0, fmt.Errorf("VM %d host port for %d out of range",
+			vmIndex, guestPort)
+	}
+	return hostPort, nil
+}
+
+// return NET_USER_HOSTFWD rule @fwd, in
+// [tcp|udp]:[hostaddr]:hostport-[guestaddr]:guestport format, with the host
+// port offset by 100 for each VM after the first, as for declared ports.
+func getUserNetHostFwd(fwd string, vmIndex int) (string, error) {
+	s := strings.SplitN(fwd, "-", 2)
+	i := strings.LastIndex(s[0], ":")
+	if len(s) != 2 || i < 0 {
+		return "", fmt.Errorf("invalid NET_USER_HOSTFWD rule: %s", fwd)
+	}
+	hostPort, err := strconv.Atoi(s[0][i+1:])
+	if err != nil || hostPort <= 0 {
+		return "", fmt.Errorf("invalid NET_USER_HOSTFWD host port: %s",
+			fwd)
+	}
+	hostPort += (vmIndex - 1) * 100
+	if hostPort > 65535 {
+		return "", fmt.Errorf("VM %d host port for %s out of range",
+			vmIndex, fwd)
+	}
+	return s[0][:i+1] + strconv.Itoa(hostPort) + "-" + s[1], nil
+}
+
+// QEMU user-mode (slirp) networking: the guest obtains an address via the
+// built-in DHCP server and manifest declared ports are forwarded from the host
+// loopback address. Additional hostfwd rules can be given via rapidos.conf
+// NET_USER_HOSTFWD.
+func getQEMUUserNetArgs(conf *RapidosConf, vmResources Resources,
+	vmIndex int) ([]string, string, error) {
+	netdev := "user,id=nw1"
+
+	for _, guestPort := range vmResources.Ports {
+		hostPort, err := getUserNetHostPort(conf, guestPort, vmIndex)
+		if err != nil {
+			return nil, "", err
+		}
+		log.Printf("VM %d port %d forwarded from 127.0.0.1:%d\n",
+			vmIndex, guestPort, hostPort)
+		netdev += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:%d",
+			hostPort, guestPort)
+	}
+	for _, fwd := range strings.Fields(conf.f["NET_USER_HOSTFWD"]) {
+		fwd, err := getUserNetHostFwd(fwd, vmIndex)
+		if err != nil {
+			return nil, "", err
+		}
+		netdev += ",hostfwd=" + fwd
+	}
+
+	// a VM network config isn't needed, but use its hostname if present
+	hostname := "rapido" + strconv.Itoa(vmIndex)
+	vmDef, err := conf.GetVMDef(vmIndex)
+	if err == nil && vmDef.Hostname != "" {
+		hostname = vmDef.Hostname
+	}
+
+	rsc := []string{"-device", "e1000,netdev=nw1", "-netdev", netdev}
+	return rsc, "ip=::::" + hostname + "::dhcp", nil
+}
+
+// Return the kernel command line network parameters for @vmDef. The kernel
+// only handles IPv4 configuration, so IPv6 (and the hostname if there's no IPv4
+// config) is passed via rapidos.* parameters, for handling by the init.
+// Up to two IPv4 @nameservers are added to a static ip= spec.
+func getKernIPArgs(vmDef *RapidosConfVM, nameservers []string) string {
+	var kernIP string
+
+	switch {
+	case vmDef.UseDHCP:
+		kernIP = "ip=dhcp"
+	case vmDef.IPAddr != "":
+		// ip=<client>:<server>:<gw>:<netmask>:<hostname>:<dev>:
+		//    <autoconf>:<dns0>:<dns1>
+		mask := net.IP(net.CIDRMask(vmDef.IPPrefixLen, 32))
+		kernIP = "ip=" + vmDef.IPAddr + "::" + vmDef.Gateway + ":" +
+			mask.String() + ":" + vmDef.Hostname
+		var dns []string
+		for _, ns := range nameservers {
+			if net.ParseIP(ns).To4() != nil && len(dns) < 2 {
+				dns = append(dns, ns)
+			}
+		}
+		if len(dns) > 0 {
+			kernIP += "::off:" + strings.Join(dns, ":")
+		}
+	default:
+		kernIP = "ip=none rapidos.hostname=" + vmDef.Hostname
+	}
+
+	if vmDef.IP6Addr != "" {
+		kernIP += " rapidos.ip6=" + vmDef.IP6Addr + "/" +
+			strconv.Itoa(vmDef.IP6PrefixLen)
+	}
+	if vmDef.Gateway6 != "" {
+		kernIP += " rapidos.gw6=" + vmDef.Gateway6
+	}
+	return kernIP
 }
 
 func getQEMURscArgs(conf *RapidosConf, vmResources Resources,
@@ -84,12 +355,31 @@ func getQEMURscArgs(conf *RapidosConf, vmResources Resources,
 		rsc = append(rsc, "-m", vmResources.Memory)
 	}
 
+	memArgs, err := getQEMUMemArgs(conf, vmResources)
+	if err != nil {
+		return nil, "", err
+	}
+	rsc = append(rsc, memArgs...)
+
 	if !vmResources.Network {
 		// all done, no network devices required
 		rsc = append(rsc, "-net", "none")
 		return rsc, "ip=none", nil
 	}
 
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return nil, "", err
+	}
+	if netMode == netModeUser {
+		netArgs, kernIP, err := getQEMUUserNetArgs(conf, vmResources,
+			vmIndex)
+		if err != nil {
+			return nil, "", err
+		}
+		return append(rsc, netArgs...), kernIP, nil
+	}
+
 	vmDef, err := conf.GetVMDef(vmIndex)
 	if err != nil {
 		return nil, "", err
@@ -99,71 +389,459 @@ func getQEMURscArgs(conf *RapidosConf, vmResources Resources,
 		"e1000,netdev=nw1,mac="+vmDef.MACAddr, "-netdev",
 		"tap,id=nw1,script=no,downscript=no,ifname="+vmDef.TapDev)
 
-	kernIP := "ip="
-	if vmDef.UseDHCP {
-		kernIP += "dhcp"
-	} else {
-		kernIP += vmDef.IPAddr + ":::255.255.255.0:" + vmDef.Hostname
+	nameservers, err := conf.GetNameservers()
+	if err != nil {
+		return nil, "", err
 	}
 
-	return rsc, kernIP, nil
+	return rsc, getKernIPArgs(vmDef, nameservers), nil
 }
 
-func runQEMU(conf *RapidosConf, imgPath string, resc Resources,
-	vmPidPath string, vmIndex int) error {
-	qemuBins, err := FindBins([]string{"qemu-kvm", "kvm"},
+// Return the QEMU command for booting VM @vmIndex. If @consolePath is
+// provided, then QEMU daemonizes after startup, with console output
+// redirected to the file at @consolePath.
+func getQEMUCmd(conf *RapidosConf, imgPath string, resc Resources,
+	vmPidPath string, vmIndex int, consolePath string) (*exec.Cmd, error) {
+	a, err := conf.getArchDef()
+	if err != nil {
+		return nil, err
+	}
+
+	qemuBins, err := FindBins(a.qemuBins(),
 		true) // ignoreMissing=true
 	if len(qemuBins) == 0 || err != nil {
-		return fmt.Errorf("failed to find qemu binary")
+		return nil, fmt.Errorf("failed to find qemu binary")
 	}
 
 	kern, err := conf.GetKernImgPath()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	qemuCmd := []string{"-kernel", kern}
+	qemuCmd = append(qemuCmd, a.qemuMachineArgs(resc.CPUModel)...)
+	if a.exitDev != "" {
+		qemuCmd = append(qemuCmd, "-device", a.exitDev)
+	}
+	// kernel panics reboot immediately, which QEMU turns into an exit
+	qemuCmd = append(qemuCmd, "-no-reboot")
+	watchdog, err := conf.GetWatchdog()
+	if err != nil {
+		return nil, err
+	}
+	if watchdog {
+		// serviced by the guest watchdogd
+		qemuCmd = append(qemuCmd, "-device", "i6300esb",
+			"-watchdog-action", "reset")
+	}
 
 	if imgPath != "" {
 		qemuCmd = append(qemuCmd, "-initrd", imgPath)
 	}
 
 	qemuCmd = append(qemuCmd, "-pidfile", vmPidPath)
+	// QMP control socket, used by rapidos -stop and -qmp
+	qemuCmd = append(qemuCmd, "-qmp",
+		"unix:"+getQMPPath(vmPidPath)+",server,nowait")
+	if consolePath == "" {
+		// followed by runQEMU()
+		qemuCmd = append(qemuCmd, "-chardev", "socket,id=qmpev,path="+
+			getQMPEventsPath(vmPidPath)+",server,nowait",
+			"-mon", "chardev=qmpev,mode=control")
+	}
+	// results channel, written to by uinit_common.SendResult()
+	qemuCmd = append(qemuCmd, getQEMUResultsArgs(vmPidPath)...)
 
 	qemuRscArgs, kernIP, err := getQEMURscArgs(conf, resc, vmIndex)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	qemuCmd = append(qemuCmd, qemuRscArgs...)
 
-	qemuCmd = append(qemuCmd, "-append", kernIP+" console=ttyS0")
+	// disk backing files are kept alongside the image
+	qemuDiskArgs, err := getQEMUDiskArgs(resc, filepath.Dir(imgPath),
+		vmIndex)
+	if err != nil {
+		return nil, err
+	}
+	qemuCmd = append(qemuCmd, qemuDiskArgs...)
 
-	qemuExtraArgs, err := conf.GetQEMUExtraArgs()
+	kernArgs := []string{kernIP, "console=" + a.console, "panic=-1"}
+	kernArgs = append(kernArgs, resc.KernelArgs...)
+	kernExtraArgs, err := conf.GetKernelExtraArgs()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	qemuCmd = append(qemuCmd, qemuExtraArgs...)
+	kernArgs = append(kernArgs, kernExtraArgs...)
+	qemuCmd = append(qemuCmd, "-append", strings.Join(kernArgs, " "))
 
-	// TODO support manifest provided supplimental QEMU args
+	// manifest args first, so that rapidos.conf can override them
+	qemuCmd = append(qemuCmd, resc.QEMUArgs...)
+	qemuExtraArgs, err := conf.GetQEMUExtraArgs()
+	if err != nil {
+		return nil, err
+	}
+	if consolePath != "" {
+		qemuCmd = append(qemuCmd, "-display", "none", "-daemonize",
+			"-serial", "file:"+consolePath)
+		for _, arg := range qemuExtraArgs {
+			// -nographic can't be combined with -daemonize
+			if arg != "-nographic" {
+				qemuCmd = append(qemuCmd, arg)
+			}
+		}
+	} else {
+		qemuCmd = append(qemuCmd, qemuExtraArgs...)
+	}
 
 	if conf.Debug {
 		fmt.Printf("running: %v\n", qemuCmd)
 	}
 
-	cmd := exec.Command(qemuBins[0], qemuCmd...)
+	return exec.Command(qemuBins[0], qemuCmd...), nil
+}
+
+// VMExitReason describes why a VM didn't shut down cleanly
+type VMExitReason int
+
+const (
+	// VM didn't report that it was ready within BOOT_TIMEOUT
+	VMBootTimeout VMExitReason = iota + 1
+	// VM ran for longer than RUN_TIMEOUT
+	VMRunTimeout
+	// VM reset following a kernel panic (panic=-1) seen on the console
+	VMPanic
+	// VM reset by the WATCHDOG device
+	VMWatchdog
+	// VM reset without a panic, e.g. due to a guest reboot
+	VMReset
+	// kernel splat seen on the console with FAIL_ON_SPLAT="1"
+	VMSplat
+)
+
+// VMExitError is returned by Boot and Run if a VM was killed due to a timeout,
+// or reset without a clean shutdown.
+type VMExitError struct {
+	VMIndex int
+	Reason  VMExitReason
+	Timeout time.Duration
+	// first splat seen on the console, if any
+	Splat *ConsoleSplat
+}
+
+func (e *VMExitError) Error() string {
+	switch e.Reason {
+	case VMBootTimeout:
+		return fmt.Sprintf("VM %d killed: not ready within %v boot "+
+			"timeout", e.VMIndex, e.Timeout)
+	case VMRunTimeout:
+		return fmt.Sprintf("VM %d killed: %v run timeout exceeded",
+			e.VMIndex, e.Timeout)
+	case VMPanic:
+		return fmt.Sprintf("VM %d reset due to %s", e.VMIndex,
+			e.Splat.Line)
+	case VMWatchdog:
+		return fmt.Sprintf("VM %d reset by watchdog", e.VMIndex)
+	case VMReset:
+		return fmt.Sprintf("VM %d reset without a kernel panic, e.g. "+
+			"via reboot. See console output", e.VMIndex)
+	case VMSplat:
+		return fmt.Sprintf("VM %d kernel %s: %s", e.VMIndex,
+			e.Splat.Kind, e.Splat.Line)
+	}
+	return fmt.Sprintf("VM %d exited unexpectedly", e.VMIndex)
+}
+
+// RunErrorExitCode is the rapidos -run exit status for VM failures other than
+// a VMExitError, e.g. if the uinit failed or no run status was reported.
+const RunErrorExitCode = 125
+
+// ExitCode returns a rapidos exit status which is distinct for each Reason,
+// with 124 for VMRunTimeout matching timeout(1).
+func (e *VMExitError) ExitCode() int {
+	switch e.Reason {
+	case VMRunTimeout:
+		return 124
+	case VMBootTimeout:
+		return 123
+	case VMPanic:
+		return 122
+	case VMWatchdog:
+		return 121
+	case VMReset:
+		return 120
+	case VMSplat:
+		return 119
+	}
+	return 1
+}
+
+// collect QMP events for the VM at @vmPidPath until QEMU exits, retrying the
+// connection until the events socket is available or @exited is closed.
+func followQMPEvents(vmPidPath string, exited <-chan struct{}) []qmp.Event {
+	var c *qmp.Client
+	var events []qmp.Event
+
+	for c == nil {
+		var err error
+		c, err = qmp.Dial(getQMPEventsPath(vmPidPath),
+			time.Duration(time.Second))
+		if err == nil {
+			break
+		}
+		select {
+		case <-exited:
+			return nil
+		case <-time.After(time.Duration(100 * time.Millisecond)):
+		}
+	}
+	defer c.Close()
+
+	for {
+		ev, err := c.ReadEvent()
+		if err != nil {
+			return events // QEMU exited
+		}
+		events = append(events, *ev)
+	}
+}
+
+// return an error if QMP @events indicate that VM @vmIndex didn't shut down
+// cleanly. QEMU exits on guest reset due to -no-reboot. A reset is only
+// attributed to a kernel panic if @panicSplat was seen on the console.
+func eventsExitError(vmIndex int, events []qmp.Event,
+	panicSplat *ConsoleSplat) error {
+	for _, ev := range events {
+		if ev.Event == "WATCHDOG" {
+			return &VMExitError{VMIndex: vmIndex, Reason: VMWatchdog}
+		}
+	}
+	for _, ev := range events {
+		if ev.Event != "SHUTDOWN" {
+			continue
+		}
+		var data struct {
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(ev.Data, &data)
+		if data.Reason != "guest-reset" {
+			continue
+		}
+		if panicSplat != nil {
+			return &VMExitError{VMIndex: vmIndex, Reason: VMPanic,
+				Splat: panicSplat}
+		}
+		return &VMExitError{VMIndex: vmIndex, Reason: VMReset}
+	}
+	return nil
+}
+
+// run VM @vmIndex in the foreground, killing it if the BOOT_TIMEOUT or
+// @runTimeout are exceeded. Console output is logged and scanned for kernel
+// splats. Results reported by the VM are returned once QEMU exits.
+func runQEMU(conf *RapidosConf, imgPath string, resc Resources,
+	vmPidPath string, vmIndex int, runTimeout time.Duration) ([]VMResult,
+	error) {
+	bootTimeout, err := conf.GetBootTimeout()
+	if err != nil {
+		return nil, err
+	}
+	failOnSplat, err := conf.GetFailOnSplat()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := getQEMUCmd(conf, imgPath, resc, vmPidPath, vmIndex, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeVMInfo(conf, imgPath, resc, vmPidPath, vmIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	err = removeResults(vmPidPath)
+	if err != nil {
+		return nil, err
+	}
+	var results []VMResult
+	done := make(chan struct{})
+	followed := make(chan struct{})
+	ready := make(chan struct{})
+	go func() {
+		readySeen := false
+		followResults(getResultsPath(vmPidPath), done, func(r VMResult) {
+			results = append(results, r)
+			if conf.Debug || r.Event == resultFailed {
+				fmt.Fprintf(os.Stderr, "VM %d %s: %s\n", vmIndex,
+					r.Event, r.Message)
+			}
+			if r.Event == resultReady && !readySeen {
+				readySeen = true
+				close(ready)
+			}
+		})
+		close(followed)
+	}()
+
+	consolePath := getConsolePath(vmPidPath)
+	consoleLog, err := os.Create(consolePath)
+	if err != nil {
+		close(done)
+		<-followed
+		return nil, err
+	}
+	defer consoleLog.Close()
+	var console consoleScanner
+
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = io.MultiWriter(os.Stdout, consoleLog, &console)
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err = cmd.Start()
 	if err != nil {
-		return err
+		close(done)
+		<-followed
+		return nil, err
 	}
 
-	return nil
+	var events []qmp.Event
+	eventsFollowed := make(chan struct{})
+	go func() {
+		events = followQMPEvents(vmPidPath, done)
+		close(eventsFollowed)
+	}()
+
+	// kill QEMU if any timeout is exceeded. The decision to kill is only
+	// made while QEMU hasn't exited, so that a VM which exits as the timer
+	// fires isn't reported as having been killed.
+	var killMutex sync.Mutex
+	var killed *VMExitError
+	exited := false
+	go func() {
+		var bootTimer, runTimer <-chan time.Time
+		readyCh := ready
+		if bootTimeout > 0 {
+			bootTimer = time.After(bootTimeout)
+		}
+		if runTimeout > 0 {
+			runTimer = time.After(runTimeout)
+		}
+		var exitErr *VMExitError
+		for exitErr == nil {
+			select {
+			case <-done:
+				return
+			case <-readyCh:
+				readyCh = nil
+				bootTimer = nil
+			case <-bootTimer:
+				exitErr = &VMExitError{VMIndex: vmIndex,
+					Reason: VMBootTimeout, Timeout: bootTimeout}
+			case <-runTimer:
+				exitErr = &VMExitError{VMIndex: vmIndex,
+					Reason: VMRunTimeout, Timeout: runTimeout}
+			}
+		}
+
+		killMutex.Lock()
+		if exited {
+			killMutex.Unlock()
+			return
+		}
+		killed = exitErr
+		cmd.Process.Signal(syscall.SIGTERM)
+		killMutex.Unlock()
+
+		select {
+		case <-done:
+		case <-time.After(qemuTermGrace):
+			// a no-op if Wait() has reaped QEMU in the meantime
+			cmd.Process.Kill()
+		}
+	}()
+
+	err = cmd.Wait()
+	killMutex.Lock()
+	exited = true
+	killMutex.Unlock()
+	close(done)
+	<-followed
+	<-eventsFollowed
+
+	var firstSplat *ConsoleSplat
+	if summary := console.summary(vmIndex, consolePath); summary != "" {
+		fmt.Fprintf(os.Stderr, "\n%s", summary)
+		firstSplat = &console.splats[0]
+	}
+
+	if killed != nil {
+		// QEMU may not have had a chance to clean up
+		removeVMState(vmPidPath)
+		return results, killed
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok &&
+		exitErr.ExitCode() == uinitFailExitCode {
+		return results, fmt.Errorf("VM %d uinit failed, see console "+
+			"output", vmIndex)
+	} else if err != nil {
+		return results, err
+	}
+	err = eventsExitError(vmIndex, events, console.find("panic"))
+	if exitErr, ok := err.(*VMExitError); ok {
+		if exitErr.Splat == nil {
+			exitErr.Splat = firstSplat
+		}
+		return results, exitErr
+	}
+	if failOnSplat && firstSplat != nil {
+		return results, &VMExitError{VMIndex: vmIndex, Reason: VMSplat,
+			Splat: firstSplat}
+	}
+	return results, nil
+}
+
+// return the maximum number of VMs which can be booted with @resc
+func getMaxVMs(conf *RapidosConf, resc Resources) (int, error) {
+	netMode, err := conf.GetNetMode()
+	if err != nil {
+		return 0, err
+	}
+
+	if resc.Network && netMode == netModeBridge {
+		// for network enabled VMs we need per-VM MAC/IP configuration
+		// and a corresponding tap device. As such we limit to the
+		// number of VM network configs present in rapidos.conf.
+		maxVMs := conf.NumVMDefs()
+		if maxVMs == 0 {
+			return 0, fmt.Errorf("rapidos.conf lacks VM network config")
+		}
+		return maxVMs, nil
+	}
+	return 1000, nil // no effective limit
+}
+
+// return the lowest VM index which isn't already running with @resc
+func getFreeVMIndex(conf *RapidosConf, resc Resources,
+	pidsDir string) (int, error) {
+	maxVMs, err := getMaxVMs(conf, resc)
+	if err != nil {
+		return 0, err
+	}
+
+	for vmIndex := 1; vmIndex <= maxVMs; vmIndex++ {
+		isRunning, err := checkQEMUProc(getPidPath(pidsDir, vmIndex))
+		if err != nil {
+			return 0, err
+		}
+		if !isRunning {
+			return vmIndex, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d configured VMs are already running", maxVMs)
 }
 
 func Boot(conf *RapidosConf, imgPath string, pidsDir string) error {
 	var resc Resources
-	var maxVMs int
 
 	// interface here is pretty suboptimal
 	err := resc.Retrieve(imgPath)
@@ -171,27 +849,54 @@ func Boot(conf *RapidosConf, imgPath string, pidsDir string) error {
 		return err
 	}
 
-	if resc.Network {
-		// for network enabled VMs we need per-VM MAC/IP configuration
-		// and a corresponding tap device. As such we limit to the
-		// number of VM network configs supported in rapidos.conf.
-		maxVMs = 3
-	} else {
-		maxVMs = 1000 // no effective limit
+	vmIndex, err := getFreeVMIndex(conf, resc, pidsDir)
+	if err != nil {
+		return err
 	}
+	runTimeout, err := conf.GetRunTimeout()
+	if err != nil {
+		return err
+	}
+	results, err := runQEMU(conf, imgPath, resc,
+		getPidPath(pidsDir, vmIndex), vmIndex, runTimeout)
+	if err != nil {
+		return err
+	}
+	return resultsFailure(vmIndex, results)
+}
 
-	for vmIndex := 1; vmIndex <= maxVMs; vmIndex++ {
-		vmPidPath := getPidPath(pidsDir, vmIndex)
-		isRunning, err := checkQEMUProc(vmPidPath)
+// Run boots a VM which runs @runCmd after its uinit completes, and then powers
+// off. The exit status of @runCmd is returned. The VM is killed if it runs for
+// longer than @timeout, or RUN_TIMEOUT if zero.
+func Run(conf *RapidosConf, imgPath string, pidsDir string, runCmd string,
+	timeout time.Duration) (int, error) {
+	var resc Resources
+
+	err := resc.Retrieve(imgPath)
+	if err != nil {
+		return 0, err
+	}
+	if timeout == 0 {
+		timeout, err = conf.GetRunTimeout()
 		if err != nil {
-			return err
-		}
-		if isRunning {
-			continue
+			return 0, err
 		}
-		return runQEMU(conf, imgPath, resc, vmPidPath, vmIndex)
 	}
+	runArg, err := getRunKernArg(runCmd)
+	if err != nil {
+		return 0, err
+	}
+	// copy, to avoid modifying the retrieved slice
+	resc.KernelArgs = append(append([]string{}, resc.KernelArgs...), runArg)
 
-	// we only get here if no VMs were started
-	return fmt.Errorf("rapidos.go only supports a maximum of %d VMs", maxVMs)
+	vmIndex, err := getFreeVMIndex(conf, resc, pidsDir)
+	if err != nil {
+		return 0, err
+	}
+	results, err := runQEMU(conf, imgPath, resc,
+		getPidPath(pidsDir, vmIndex), vmIndex, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return resultsRunStatus(vmIndex, results)
 }
@@ -0,0 +1,162 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rapidos
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitlab.com/rapidos/rapidos/internal/pkg/qmp"
+)
+
+func TestEventsExitError(t *testing.T) {
+	shutdown := func(reason string) qmp.Event {
+		return qmp.Event{Event: "SHUTDOWN", Data: json.RawMessage(
+			`{"guest": true, "reason": "` + reason + `"}`)}
+	}
+	panicSplat := &ConsoleSplat{Kind: "panic",
+		Line: "Kernel panic - not syncing: sysrq triggered crash"}
+	tests := []struct {
+		name       string
+		events     []qmp.Event
+		panicSplat *ConsoleSplat
+		reason     VMExitReason
+	}{
+		{"clean", []qmp.Event{shutdown("guest-shutdown")}, nil, 0},
+		{"no events", nil, nil, 0},
+		{"panic", []qmp.Event{shutdown("guest-reset")}, panicSplat,
+			VMPanic},
+		{"reset", []qmp.Event{shutdown("guest-reset")}, nil, VMReset},
+		{"watchdog", []qmp.Event{{Event: "WATCHDOG",
+			Data: json.RawMessage(`{"action": "reset"}`)},
+			shutdown("guest-reset")}, nil, VMWatchdog},
+	}
+
+	for _, test := range tests {
+		err := eventsExitError(1, test.events, test.panicSplat)
+		if test.reason == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		exitErr, ok := err.(*VMExitError)
+		if !ok || exitErr.Reason != test.reason || exitErr.VMIndex != 1 {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestVMExitCodes(t *testing.T) {
+	exitCodes := make(map[int]VMExitReason)
+	for r := VMBootTimeout; r <= VMSplat; r++ {
+		code := (&VMExitError{Reason: r}).ExitCode()
+		if other, ok := exitCodes[code]; ok || code == 1 {
+			t.Errorf("reason %d exit code %d not distinct from %d",
+				r, code, other)
+		}
+		exitCodes[code] = r
+	}
+}
+
+// serve QMP on @sockPath to one client at a time, as QEMU does. @event is sent
+// following capabilities negotiation, after which @accepted is closed. Clients
+// are disconnected once @release is closed.
+func serveTestQMP(t *testing.T, sockPath string, event string,
+	accepted chan<- struct{}, release <-chan struct{}) net.Listener {
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-release
+				conn.Close()
+			}()
+			conn.Write([]byte(`{"QMP": {}}` + "\n"))
+			scanner := bufio.NewScanner(conn)
+			negotiated := false
+			for scanner.Scan() {
+				conn.Write([]byte(`{"return": {"status": ` +
+					`"running", "running": true}}` + "\n"))
+				if !negotiated && event != "" {
+					conn.Write([]byte(event + "\n"))
+					close(accepted)
+				}
+				negotiated = true
+			}
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestDialQMPWhileFollowing(t *testing.T) {
+	pidsDir, err := ioutil.TempDir("", "rapidos-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidsDir)
+
+	vmPidPath := getPidPath(pidsDir, 1)
+	err = ioutil.WriteFile(vmPidPath, []byte(strconv.Itoa(os.Getpid())),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan struct{})
+	release := make(chan struct{})
+	ln := serveTestQMP(t, getQMPPath(vmPidPath), "", nil, release)
+	defer ln.Close()
+	ln = serveTestQMP(t, getQMPEventsPath(vmPidPath),
+		`{"event": "STOP", "data": {}}`, accepted, release)
+	defer ln.Close()
+
+	var events []qmp.Event
+	followed := make(chan struct{})
+	go func() {
+		events = followQMPEvents(vmPidPath, nil)
+		close(followed)
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(time.Duration(5 * time.Second)):
+		t.Fatalf("events monitor not followed")
+	}
+
+	c, err := DialQMP(pidsDir, 1, time.Duration(time.Second))
+	if err != nil {
+		t.Fatalf("DialQMP failed while following events: %v", err)
+	}
+	st, err := c.QueryStatus()
+	if err != nil || !st.Running {
+		t.Errorf("unexpected status %+v: %v", st, err)
+	}
+	c.Close()
+
+	close(release)
+	<-followed
+	if len(events) != 1 || events[0].Event != "STOP" {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
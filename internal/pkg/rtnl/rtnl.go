@@ -0,0 +1,323 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+// Package rtnl provides the handful of rtnetlink and tun operations needed to
+// provision the rapidos bridge and VM tap devices. Root (or CAP_NET_ADMIN) is
+// required.
+package rtnl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// IFLA_LINKINFO nested attribute, not provided by syscall
+const iflaInfoKind = 1
+
+// IPv6 duplicate address detection opt-out, not provided by syscall
+const ifaFNoDAD = 0x02
+
+// netlink messages use host byte order
+var nativeEndian binary.ByteOrder
+
+func init() {
+	var x uint16 = 0x0102
+	if *(*byte)(unsafe.Pointer(&x)) == 0x02 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+type Conn struct {
+	fd  int
+	seq uint32
+}
+
+func Dial() (*Conn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW,
+		syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Conn{fd: fd}, nil
+}
+
+func (c *Conn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+func align4(l int) int {
+	return (l + 3) &^ 3
+}
+
+func rtattr(typ uint16, data []byte) []byte {
+	l := 4 + len(data)
+	b := make([]byte, align4(l))
+	nativeEndian.PutUint16(b[0:], uint16(l))
+	nativeEndian.PutUint16(b[2:], typ)
+	copy(b[4:], data)
+	return b
+}
+
+func rtattrU32(typ uint16, val uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, val)
+	return rtattr(typ, b)
+}
+
+func ifInfomsg(index int, flags uint32, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	nativeEndian.PutUint32(b[8:], flags)
+	nativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// prefix @body with a netlink header for an acked request
+func nlRequest(typ uint16, flags uint16, seq uint32, body []byte) []byte {
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	nativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	nativeEndian.PutUint16(msg[4:], typ)
+	nativeEndian.PutUint16(msg[6:],
+		flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:], seq)
+	return append(msg, body...)
+}
+
+// send a request and wait for the corresponding ack
+func (c *Conn) execute(typ uint16, flags uint16, body []byte) error {
+	c.seq++
+	msg := nlRequest(typ, flags, c.seq, body)
+
+	err := syscall.Sendto(c.fd, msg, 0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq ||
+				m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink ack")
+			}
+			errno := int32(nativeEndian.Uint32(m.Data[0:4]))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(-errno)
+		}
+	}
+}
+
+func ifIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return iface.Index, nil
+}
+
+func bridgeAddMsg(name string) []byte {
+	body := ifInfomsg(0, 0, 0)
+	body = append(body, rtattr(syscall.IFLA_IFNAME,
+		append([]byte(name), 0))...)
+	return append(body, rtattr(syscall.IFLA_LINKINFO,
+		rtattr(iflaInfoKind, []byte("bridge")))...)
+}
+
+// BridgeAdd creates bridge device @name
+func (c *Conn) BridgeAdd(name string) error {
+	return c.execute(syscall.RTM_NEWLINK,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, bridgeAddMsg(name))
+}
+
+// LinkDel deletes device @name
+func (c *Conn) LinkDel(name string) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	return c.execute(syscall.RTM_DELLINK, 0, ifInfomsg(index, 0, 0))
+}
+
+// LinkSetMaster enslaves @name to @master, or releases it if @master is empty
+func (c *Conn) LinkSetMaster(name string, master string) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	masterIndex := 0
+	if master != "" {
+		masterIndex, err = ifIndex(master)
+		if err != nil {
+			return err
+		}
+	}
+	return c.execute(syscall.RTM_NEWLINK, 0,
+		linkSetMasterMsg(index, masterIndex))
+}
+
+func linkSetMasterMsg(index int, masterIndex int) []byte {
+	return append(ifInfomsg(index, 0, 0),
+		rtattrU32(syscall.IFLA_MASTER, uint32(masterIndex))...)
+}
+
+// LinkSetUp brings @name up if @up is true, otherwise down
+func (c *Conn) LinkSetUp(name string, up bool) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	var flags uint32
+	if up {
+		flags = syscall.IFF_UP
+	}
+	return c.execute(syscall.RTM_NEWLINK, 0,
+		ifInfomsg(index, flags, syscall.IFF_UP))
+}
+
+func addrMsg(index int, addr *net.IPNet) []byte {
+	family := syscall.AF_INET6
+	ip := addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		ip = ip4
+	}
+	prefixLen, _ := addr.Mask.Size()
+
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = byte(family)
+	body[1] = byte(prefixLen)
+	if family == syscall.AF_INET6 {
+		// rapidos networks are private, so skip DAD to ensure that
+		// the address is immediately usable
+		body[2] = ifaFNoDAD
+	}
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	body = append(body, rtattr(syscall.IFA_LOCAL, ip)...)
+	return append(body, rtattr(syscall.IFA_ADDRESS, ip)...)
+}
+
+// AddrAdd assigns @addr to @name
+func (c *Conn) AddrAdd(name string, addr *net.IPNet) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	return c.execute(syscall.RTM_NEWADDR,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, addrMsg(index, addr))
+}
+
+// AddrDel removes @addr from @name
+func (c *Conn) AddrDel(name string, addr *net.IPNet) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	return c.execute(syscall.RTM_DELADDR, 0, addrMsg(index, addr))
+}
+
+func routeDefaultMsg(index int, gw net.IP) []byte {
+	family := syscall.AF_INET6
+	ip := gw.To16()
+	if ip4 := gw.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		ip = ip4
+	}
+
+	body := make([]byte, syscall.SizeofRtMsg)
+	body[0] = byte(family)
+	body[4] = syscall.RT_TABLE_MAIN
+	body[5] = syscall.RTPROT_BOOT
+	body[6] = syscall.RT_SCOPE_UNIVERSE
+	body[7] = syscall.RTN_UNICAST
+	body = append(body, rtattr(syscall.RTA_GATEWAY, ip)...)
+	return append(body, rtattrU32(syscall.RTA_OIF, uint32(index))...)
+}
+
+// RouteAddDefault adds a default route via gateway @gw on device @name
+func (c *Conn) RouteAddDefault(name string, gw net.IP) error {
+	index, err := ifIndex(name)
+	if err != nil {
+		return err
+	}
+	return c.execute(syscall.RTM_NEWROUTE,
+		syscall.NLM_F_CREATE|syscall.NLM_F_EXCL,
+		routeDefaultMsg(index, gw))
+}
+
+// struct ifreq, as used by the tun ioctls
+type ifReq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [24 - 2]byte
+}
+
+func tunIoctl(fd uintptr, req uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// TapAdd creates persistent tap device @name, owned by @uid. It can be
+// removed via LinkDel().
+func TapAdd(name string, uid int) error {
+	if len(name) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("tap device name %s too long", name)
+	}
+
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var ifr ifReq
+	copy(ifr.name[:], name)
+	ifr.flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	err = tunIoctl(f.Fd(), syscall.TUNSETIFF,
+		uintptr(unsafe.Pointer(&ifr)))
+	if err != nil {
+		return err
+	}
+	err = tunIoctl(f.Fd(), syscall.TUNSETOWNER, uintptr(uid))
+	if err != nil {
+		return err
+	}
+	return tunIoctl(f.Fd(), syscall.TUNSETPERSIST, 1)
+}
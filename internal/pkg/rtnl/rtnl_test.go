@@ -0,0 +1,154 @@
+// Copyright (C) SUSE LLC 2019, all rights reserved.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+// FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+// details.
+
+package rtnl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// message encoding only, so no CAP_NET_ADMIN is needed
+
+func ne16(v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return b
+}
+
+func ne32(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAlign4(t *testing.T) {
+	for in, want := range map[int]int{0: 0, 1: 4, 3: 4, 4: 4, 5: 8,
+		10: 12} {
+		if got := align4(in); got != want {
+			t.Errorf("align4(%d): got %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	v4Net := &net.IPNet{IP: net.ParseIP("192.168.155.1"),
+		Mask: net.CIDRMask(24, 32)}
+	v6Net := &net.IPNet{IP: net.ParseIP("fd00:155::1"),
+		Mask: net.CIDRMask(64, 128)}
+	v6 := v6Net.IP.To16()
+
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{
+			name: "aligned attribute",
+			got:  rtattr(3, []byte("br0\x00")),
+			want: cat(ne16(8), ne16(3), []byte("br0\x00")),
+		},
+		{
+			// length excludes the padding
+			name: "padded attribute",
+			got:  rtattr(1, []byte("bridge")),
+			want: cat(ne16(10), ne16(1), []byte("bridge"),
+				[]byte{0, 0}),
+		},
+		{
+			name: "u32 attribute",
+			got:  rtattrU32(10, 0x01020304),
+			want: cat(ne16(8), ne16(10), ne32(0x01020304)),
+		},
+		{
+			name: "link up",
+			got:  ifInfomsg(3, 0x1, 0x1),
+			want: cat([]byte{0, 0}, ne16(0), ne32(3), ne32(0x1),
+				ne32(0x1)),
+		},
+		{
+			name: "bridge add",
+			got:  bridgeAddMsg("rbr0"),
+			want: cat(make([]byte, 16),
+				// IFLA_IFNAME, NUL terminated and padded
+				ne16(9), ne16(3), []byte("rbr0\x00"),
+				[]byte{0, 0, 0},
+				// IFLA_LINKINFO containing IFLA_INFO_KIND
+				ne16(16), ne16(18),
+				ne16(10), ne16(1), []byte("bridge"),
+				[]byte{0, 0}),
+		},
+		{
+			name: "link set master",
+			got:  linkSetMasterMsg(5, 7),
+			want: cat([]byte{0, 0}, ne16(0), ne32(5), ne32(0),
+				ne32(0),
+				// IFLA_MASTER
+				ne16(8), ne16(10), ne32(7)),
+		},
+		{
+			name: "IPv4 address",
+			got:  addrMsg(4, v4Net),
+			want: cat([]byte{2, 24, 0, 0}, ne32(4),
+				// IFA_LOCAL and IFA_ADDRESS
+				ne16(8), ne16(2), []byte{192, 168, 155, 1},
+				ne16(8), ne16(1), []byte{192, 168, 155, 1}),
+		},
+		{
+			// IFA_F_NODAD set for IPv6
+			name: "IPv6 address",
+			got:  addrMsg(4, v6Net),
+			want: cat([]byte{10, 64, 2, 0}, ne32(4),
+				ne16(20), ne16(2), v6,
+				ne16(20), ne16(1), v6),
+		},
+		{
+			name: "IPv4 default route",
+			got:  routeDefaultMsg(4, net.ParseIP("192.168.155.1")),
+			// main table, boot protocol, universe scope, unicast
+			want: cat([]byte{2, 0, 0, 0, 254, 3, 0, 1}, ne32(0),
+				// RTA_GATEWAY and RTA_OIF
+				ne16(8), ne16(5), []byte{192, 168, 155, 1},
+				ne16(8), ne16(4), ne32(4)),
+		},
+		{
+			name: "IPv6 default route",
+			got:  routeDefaultMsg(4, net.ParseIP("fd00:155::1")),
+			want: cat([]byte{10, 0, 0, 0, 254, 3, 0, 1}, ne32(0),
+				ne16(20), ne16(5), v6,
+				ne16(8), ne16(4), ne32(4)),
+		},
+		{
+			// RTM_NEWLINK with NLM_F_CREATE|NLM_F_EXCL, plus the
+			// NLM_F_REQUEST|NLM_F_ACK added for all requests
+			name: "request header",
+			got:  nlRequest(16, 0x600, 42, []byte{1, 2, 3, 4}),
+			want: cat(ne32(20), ne16(16), ne16(0x605), ne32(42),
+				ne32(0), []byte{1, 2, 3, 4}),
+		},
+	}
+
+	for _, tc := range tests {
+		if !bytes.Equal(tc.got, tc.want) {
+			t.Errorf("%s: got % x, want % x", tc.name, tc.got,
+				tc.want)
+		}
+		if len(tc.got)%4 != 0 {
+			t.Errorf("%s: length %d not 4 byte aligned", tc.name,
+				len(tc.got))
+		}
+	}
+}
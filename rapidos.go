@@ -12,13 +12,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"gitlab.com/rapidos/rapidos/internal/pkg/rapidos"
 
@@ -53,8 +60,19 @@ type cliParams struct {
 	imgPath     string
 	confOverlay map[string]string
 	bootVM      bool
+	validate    bool
 	cutInitName string
 	qemuPidDir  string
+	status      bool
+	stopVMs     string
+	stopTimeout time.Duration
+	qmpVM       int
+	netSetup    bool
+	netTeardown bool
+	dhcpServer  bool
+	clusterVMs  int
+	runCmd      string
+	runTimeout  time.Duration
 }
 
 // string "get" callback for -C <key>=<val>. Not sure what to return.
@@ -72,6 +90,218 @@ func (params *cliParams) Set(value string) error {
 	return nil
 }
 
+// print details for running VMs, after cleaning up any stale state
+func printStatus(pidsDir string) error {
+	cleaned, err := rapidos.CleanStaleVMs(pidsDir)
+	if err != nil {
+		return err
+	}
+	for _, vmIndex := range cleaned {
+		fmt.Printf("removed stale pidfile for VM %d\n", vmIndex)
+	}
+
+	vms, err := rapidos.ListVMs(pidsDir)
+	if err != nil {
+		return err
+	}
+	leases, err := rapidos.ListDHCPLeases(pidsDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if len(vms) == 0 {
+		fmt.Printf("no VMs running\n")
+	} else {
+		fmt.Fprintf(w, "VM\tPID\tIMAGE\tUPTIME\tIP\n")
+	}
+	for _, vm := range vms {
+		uptime := time.Since(vm.Started).Round(time.Second)
+		ipAddr := vm.IPAddr
+		for _, l := range leases {
+			if ipAddr == "" && strings.EqualFold(l.MAC, vm.MACAddr) {
+				ipAddr = l.IP
+			}
+		}
+		if vm.IP6Addr != "" && ipAddr != "" {
+			ipAddr += "," + vm.IP6Addr
+		} else if vm.IP6Addr != "" {
+			ipAddr = vm.IP6Addr
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", vm.Index, vm.Pid,
+			vm.Image, uptime, ipAddr)
+	}
+	err = w.Flush()
+	if err != nil || len(leases) == 0 {
+		return err
+	}
+
+	fmt.Printf("\nDHCP leases:\n")
+	fmt.Fprintf(w, "MAC\tIP\tHOSTNAME\tEXPIRES\n")
+	for _, l := range leases {
+		expires := time.Until(l.Expiry).Round(time.Second).String()
+		if l.Static {
+			expires += " (static)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.MAC, l.IP, l.Hostname,
+			expires)
+	}
+	return w.Flush()
+}
+
+// stop VM @which, which is either an index or "all"
+func stopVMs(pidsDir string, which string, timeout time.Duration) error {
+	var indices []int
+
+	if which == "all" {
+		vms, err := rapidos.ListVMs(pidsDir)
+		if err != nil {
+			return err
+		}
+		for _, vm := range vms {
+			if vm.Running {
+				indices = append(indices, vm.Index)
+			}
+		}
+	} else {
+		vmIndex, err := strconv.Atoi(which)
+		if err != nil || vmIndex < 1 {
+			return fmt.Errorf("invalid VM %s", which)
+		}
+		indices = append(indices, vmIndex)
+	}
+
+	for _, vmIndex := range indices {
+		fmt.Printf("stopping VM %d\n", vmIndex)
+	}
+	return rapidos.StopVMs(pidsDir, indices, timeout)
+}
+
+// run QMP @args against VM @vmIndex and print the result
+func qmpCommand(pidsDir string, vmIndex int, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("QMP command required: status, powerdown, " +
+			"device_add <driver> id=<id> [<prop>=<val>...], " +
+			"device_del <id>, savevm <tag>, or " +
+			"<raw-cmd> [<json-args>]")
+	}
+
+	c, err := rapidos.DialQMP(pidsDir, vmIndex,
+		time.Duration(10*time.Second))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	switch args[0] {
+	case "status":
+		st, err := c.QueryStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("VM %d: %s\n", vmIndex, st.Status)
+		return nil
+	case "powerdown":
+		return c.SystemPowerdown()
+	case "device_add":
+		if len(args) < 2 {
+			return fmt.Errorf("device_add <driver> id=<id> ...")
+		}
+		props := make(map[string]string)
+		for _, kv := range args[2:] {
+			s := strings.SplitN(kv, "=", 2)
+			if len(s) != 2 {
+				return fmt.Errorf("%s not in <prop>=<val> format",
+					kv)
+			}
+			props[s[0]] = s[1]
+		}
+		id := props["id"]
+		delete(props, "id")
+		return c.DeviceAdd(args[1], id, props)
+	case "device_del":
+		if len(args) != 2 {
+			return fmt.Errorf("device_del <id>")
+		}
+		return c.DeviceDel(args[1])
+	case "savevm":
+		if len(args) != 2 {
+			return fmt.Errorf("savevm <tag>")
+		}
+		return c.SaveVM(args[1])
+	}
+
+	// pass through any other command, with optional JSON arguments
+	var cmdArgs interface{}
+	if len(args) > 1 {
+		err = json.Unmarshal([]byte(strings.Join(args[1:], " ")),
+			&cmdArgs)
+		if err != nil {
+			return fmt.Errorf("invalid JSON arguments: %v", err)
+		}
+	}
+	ret, err := c.Execute(args[0], cmdArgs)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, ret, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", out.String())
+	return nil
+}
+
+// start a background "rapidos -dhcp-server" instance with the same config
+func startDHCPServer(params *cliParams) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-dhcp-server", "-conf", params.confPath,
+		"-pid-dir", params.qemuPidDir}
+	for k, v := range params.confOverlay {
+		args = append(args, "-C", k+"="+v)
+	}
+	if params.logPath != "" {
+		args = append(args, "-logfile", params.logPath)
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("+ started DHCP server (pid %d)\n", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// provision the bridge and taps, plus the DHCP server if configured
+func netSetup(conf *rapidos.RapidosConf, params *cliParams) error {
+	err := rapidos.NetSetup(conf)
+	if err != nil || !conf.DHCPEnabled() {
+		return err
+	}
+	err = startDHCPServer(params)
+	if err != nil {
+		rapidos.NetTeardown(conf, params.qemuPidDir)
+		return fmt.Errorf("failed to start DHCP server: %v", err)
+	}
+	return nil
+}
+
+// log @err and exit, with a status indicating why the VM failed if known,
+// otherwise @status
+func vmFatal(msg string, err error, status int) {
+	log.Printf("%s: %v", msg, err)
+	if exitErr, ok := err.(*rapidos.VMExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	os.Exit(status)
+}
+
 func main() {
 	// XXX: binary is under /tmp/go-build when run via "go run"!
 	rdir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -97,9 +327,36 @@ func main() {
 	flag.StringVar(&params.cutInitName, "cut", "",
 		"Cut an image with the provided `init`")
 	flag.BoolVar(&params.bootVM, "boot", true, "Boot the initramfs image")
+	flag.BoolVar(&params.validate, "validate", false,
+		"Check rapidos.conf for problems, considering the -cut init if "+
+			"provided, then exit")
 	flag.StringVar(&params.qemuPidDir, "pid-dir",
 		path.Join(rdir, "imgs"),
 		"Directory `path` for QEMU PID files")
+	flag.BoolVar(&params.status, "status", false,
+		"List running VMs and clean up stale PID files")
+	flag.StringVar(&params.stopVMs, "stop", "",
+		"Shut down `VM`, given as an index or \"all\"")
+	flag.DurationVar(&params.stopTimeout, "stop-timeout",
+		rapidos.DefaultStopTimeout,
+		"Wait `duration` for -stop powerdown before killing QEMU")
+	flag.IntVar(&params.qmpVM, "qmp", 0,
+		"Run the QMP command given as trailing parameters against `VM`")
+	flag.BoolVar(&params.netSetup, "net-setup", false,
+		"Provision the bridge and VM tap devices as root, then exit")
+	flag.BoolVar(&params.netTeardown, "net-teardown", false,
+		"Remove the bridge and VM tap devices as root, then exit")
+	flag.IntVar(&params.clusterVMs, "cluster", 0,
+		"Boot `N` VMs in the background, then shut them down on Ctrl-C")
+	flag.BoolVar(&params.dhcpServer, "dhcp-server", false,
+		"Run the built-in DHCP server on the bridge in the foreground")
+	flag.StringVar(&params.runCmd, "run", "",
+		"Boot a VM which runs `command` after its init, then powers "+
+			"off. Exits with the command's status, or 124 on "+
+			"timeout and 119-125 on VM failure (see readme)")
+	flag.DurationVar(&params.runTimeout, "run-timeout", 0,
+		"Kill the -run VM after `duration`. Zero uses RUN_TIMEOUT "+
+			"from rapidos.conf")
 
 	flag.Parse()
 
@@ -114,6 +371,14 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	if params.qmpVM > 0 {
+		err = qmpCommand(params.qemuPidDir, params.qmpVM, flag.Args())
+		if err != nil {
+			log.Fatalf("QMP command failed: %v", err)
+		}
+		return
+	}
+
 	if len(flag.Args()) != 0 {
 		fmt.Printf("Error: unsupported trailing parameter(s)\n")
 		usage()
@@ -125,7 +390,43 @@ func main() {
 		return
 	}
 
-	if params.cutInitName == "" {
+	if params.status {
+		err = printStatus(params.qemuPidDir)
+		if err != nil {
+			log.Fatalf("failed to get VM status: %v", err)
+		}
+		return
+	}
+
+	if params.stopVMs != "" {
+		err = stopVMs(params.qemuPidDir, params.stopVMs,
+			params.stopTimeout)
+		if err != nil {
+			log.Fatalf("failed to stop VM: %v", err)
+		}
+		return
+	}
+
+	if params.netSetup || params.netTeardown || params.dhcpServer {
+		conf, err := rapidos.ParseConf(params.confPath,
+			params.confOverlay, params.debug)
+		if err != nil {
+			log.Fatalf("failed to parse config: %v", err)
+		}
+		if params.dhcpServer {
+			err = rapidos.ServeDHCP(conf, params.qemuPidDir)
+		} else if params.netSetup {
+			err = netSetup(conf, params)
+		} else {
+			err = rapidos.NetTeardown(conf, params.qemuPidDir)
+		}
+		if err != nil {
+			log.Fatalf("network provisioning failed: %v", err)
+		}
+		return
+	}
+
+	if params.cutInitName == "" && !params.validate {
 		if !params.bootVM {
 			fmt.Printf("-cut <img>, -boot, or -list parameter required\n")
 			usage()
@@ -146,26 +447,59 @@ func main() {
 		log.Fatalf("failed to parse config: %v", err)
 	}
 
+	var m *rapidos.Manifest
 	if params.cutInitName != "" {
-		m := rapidos.LookupManifest(params.cutInitName)
+		m = rapidos.LookupManifest(params.cutInitName)
 		if m == nil {
 			fmt.Printf("Failed to lookup manifest: %s\n",
 				params.cutInitName)
 			usage()
 			return
 		}
+	}
+
+	if params.validate || m != nil {
+		errs := rapidos.ValidateConf(conf, m)
+		if len(errs) > 0 {
+			fmt.Printf("%s has %d problem(s):\n", params.confPath,
+				len(errs))
+			for _, err := range errs {
+				fmt.Printf("  %v\n", err)
+			}
+			os.Exit(1)
+		}
+		if params.validate {
+			fmt.Printf("%s OK\n", params.confPath)
+			return
+		}
+	}
 
+	if m != nil {
 		err = rapidos.Cut(conf, m, rdir, params.imgPath)
 		if err != nil {
 			log.Fatalf("failed cut image: %v", err)
 		}
 	}
 
-	if params.bootVM {
+	if params.runCmd != "" {
+		status, err := rapidos.Run(conf, params.imgPath,
+			params.qemuPidDir, params.runCmd, params.runTimeout)
+		if err != nil {
+			vmFatal("failed to run VM", err,
+				rapidos.RunErrorExitCode)
+		}
+		os.Exit(status)
+	} else if params.clusterVMs > 0 {
+		err = rapidos.BootCluster(conf, params.imgPath,
+			params.qemuPidDir, params.clusterVMs)
+		if err != nil {
+			log.Fatalf("failed to boot cluster: %v", err)
+		}
+	} else if params.bootVM {
 		// QEMU blocks in boot() until shutdown, unless run with -daemonize
 		err = rapidos.Boot(conf, params.imgPath, params.qemuPidDir)
 		if err != nil {
-			log.Fatalf("failed to boot VM: %v", err)
+			vmFatal("failed to boot VM", err, 1)
 		}
 	}
 }